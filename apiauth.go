@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+)
+
+// Scopes of API credentials, admin includes all others.
+const (
+	scopeRead   = "read"
+	scopeReload = "reload"
+	scopeAdmin  = "admin"
+)
+
+// APIConfig settings for authentication of the nixy API.
+type APIConfig struct {
+	Tokens []APICredential `toml:"token"`
+	Users  []APICredential `toml:"user"`
+	Redact []string
+	Render bool
+}
+
+// APICredential is a bearer token, or a user and password, with its scopes.
+type APICredential struct {
+	Token  string
+	User   string
+	Pass   string
+	Scopes []string
+}
+
+// routeScopes are the scopes needed for routes, all others need read.
+// Rendered configs are not redacted, so only admin may read them.
+var routeScopes = map[string]string{
+	"/v1/reload":                      scopeReload,
+	"/v1/render":                      scopeAdmin,
+	"/v1/history/{id:[0-9]+}":         scopeAdmin,
+	"/v1/history/{id:[0-9]+}/diff":    scopeAdmin,
+	"/v1/history/{id:[0-9]+}/restore": scopeAdmin,
+}
+
+var redactPatterns []*regexp.Regexp
+
+func setupAPIAuth() error {
+	for _, c := range config.API.Tokens {
+		if c.Token == "" {
+			return errors.New("api token without token")
+		}
+		err := checkScopes(c.Scopes)
+		if err != nil {
+			return err
+		}
+	}
+	for _, c := range config.API.Users {
+		if c.User == "" || c.Pass == "" {
+			return errors.New("api user without user or pass")
+		}
+		err := checkScopes(c.Scopes)
+		if err != nil {
+			return err
+		}
+	}
+	for _, p := range config.API.Redact {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return fmt.Errorf("invalid redact pattern %q: %v", p, err)
+		}
+		redactPatterns = append(redactPatterns, re)
+	}
+	return nil
+}
+
+func checkScopes(scopes []string) error {
+	for _, s := range scopes {
+		if s != scopeRead && s != scopeReload && s != scopeAdmin {
+			return fmt.Errorf("unknown api scope %q", s)
+		}
+	}
+	return nil
+}
+
+// apiAuthEnabled is true if any credentials are configured, the API is
+// open otherwise.
+func apiAuthEnabled() bool {
+	return len(config.API.Tokens) > 0 || len(config.API.Users) > 0
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// credential returns the credential a request authenticates with.
+func credential(r *http.Request) *APICredential {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token := strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+		for i, c := range config.API.Tokens {
+			if secureEqual(token, c.Token) {
+				return &config.API.Tokens[i]
+			}
+		}
+		return nil
+	}
+	if user, pass, ok := r.BasicAuth(); ok {
+		for i, c := range config.API.Users {
+			if secureEqual(user, c.User) && secureEqual(pass, c.Pass) {
+				return &config.API.Users[i]
+			}
+		}
+	}
+	return nil
+}
+
+func (c *APICredential) allowed(scope string) bool {
+	for _, s := range c.Scopes {
+		if s == scope || s == scopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// apiAuthMiddleware checks the credentials of requests against the scope
+// of the route.
+func apiAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !apiAuthEnabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		scope := scopeRead
+		if route := mux.CurrentRoute(r); route != nil {
+			if path, err := route.GetPathTemplate(); err == nil && routeScopes[path] != "" {
+				scope = routeScopes[path]
+			}
+		}
+		c := credential(r)
+		if c == nil {
+			logger.WithFields(logrus.Fields{
+				"client": r.RemoteAddr,
+				"path":   r.URL.Path,
+			}).Warn("api authentication failed")
+			go countAPIAuthFailures.Inc()
+			w.Header().Set("WWW-Authenticate", `Bearer realm="nixy"`)
+			if len(config.API.Users) > 0 {
+				w.Header().Add("WWW-Authenticate", `Basic realm="nixy"`)
+			}
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !c.allowed(scope) {
+			go countAPIAuthFailures.Inc()
+			http.Error(w, "forbidden, needs scope "+scope, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// redact replaces the values of labels and env variables matching the
+// redact patterns.
+func redact(m map[string]string) map[string]string {
+	if len(redactPatterns) == 0 || m == nil {
+		return m
+	}
+	redacted := make(map[string]string, len(m))
+	for k, v := range m {
+		redacted[k] = v
+		for _, re := range redactPatterns {
+			if re.MatchString(k) {
+				redacted[k] = "REDACTED"
+				break
+			}
+		}
+	}
+	return redacted
+}
+
+func redactApp(app App) App {
+	if len(redactPatterns) == 0 {
+		return app
+	}
+	app.Labels = redact(app.Labels)
+	app.Env = redact(app.Env)
+	tasks := make([]Task, len(app.Tasks))
+	for i, task := range app.Tasks {
+		task.Labels = redact(task.Labels)
+		tasks[i] = task
+	}
+	if app.Tasks != nil {
+		app.Tasks = tasks
+	}
+	return app
+}
+
+// redacted returns the template data as shown by the API.
+func (c *Config) redacted() *Config {
+	apps := make(map[string]App, len(c.Apps))
+	for id, app := range c.Apps {
+		apps[id] = redactApp(app)
+	}
+	return &Config{
+		Xproxy:      c.Xproxy,
+		Realm:       c.Realm,
+		Statsd:      c.Statsd,
+		LastUpdates: c.LastUpdates,
+		Apps:        apps,
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestAPIAuthMiddleware(t *testing.T) {
+	defer func(old APIConfig) { config.API = old }(config.API)
+	config.API = APIConfig{
+		Tokens: []APICredential{
+			{Token: "read-token", Scopes: []string{scopeRead}},
+			{Token: "reload-token", Scopes: []string{scopeReload}},
+			{Token: "admin-token", Scopes: []string{scopeAdmin}},
+		},
+		Users: []APICredential{
+			{User: "ops", Pass: "secret", Scopes: []string{scopeRead, scopeReload}},
+		},
+	}
+	router := apiRouter()
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		user   string
+		pass   string
+		want   int
+	}{
+		{"no credentials", "GET", "/v1/config", "", "", "", http.StatusUnauthorized},
+		{"bad token", "GET", "/v1/config", "wrong-token", "", "", http.StatusUnauthorized},
+		{"read", "GET", "/v1/config", "read-token", "", "", http.StatusOK},
+		{"read reload", "GET", "/v1/reload", "read-token", "", "", http.StatusForbidden},
+		{"read render", "POST", "/v1/render", "read-token", "", "", http.StatusForbidden},
+		{"read restore", "POST", "/v1/history/1/restore", "read-token", "", "", http.StatusForbidden},
+		{"read history", "GET", "/v1/history/1", "read-token", "", "", http.StatusForbidden},
+		{"read history diff", "GET", "/v1/history/1/diff", "read-token", "", "", http.StatusForbidden},
+		{"read history list", "GET", "/v1/history", "read-token", "", "", http.StatusOK},
+		{"reload config", "GET", "/v1/config", "reload-token", "", "", http.StatusForbidden},
+		{"reload", "GET", "/v1/reload", "reload-token", "", "", http.StatusAccepted},
+		{"admin config", "GET", "/v1/config", "admin-token", "", "", http.StatusOK},
+		{"admin restore", "POST", "/v1/history/1/restore", "admin-token", "", "", http.StatusNotFound},
+		{"basic auth", "GET", "/v1/config", "", "ops", "secret", http.StatusOK},
+		{"basic auth reload", "GET", "/v1/reload", "", "ops", "secret", http.StatusAccepted},
+		{"basic auth render", "POST", "/v1/render", "", "ops", "secret", http.StatusForbidden},
+		{"basic auth bad pass", "GET", "/v1/config", "", "ops", "wrong", http.StatusUnauthorized},
+		{"basic auth unknown user", "GET", "/v1/config", "", "root", "secret", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.path, nil)
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		if test.user != "" {
+			req.SetBasicAuth(test.user, test.pass)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != test.want {
+			t.Errorf("%s: %s %s = %d, expected %d", test.name, test.method, test.path, w.Code, test.want)
+		}
+	}
+	// drain the reloads queued above.
+	for len(eventqueue) > 0 {
+		<-eventqueue
+	}
+}
+
+func TestAPIAuthDisabled(t *testing.T) {
+	defer func(old APIConfig) { config.API = old }(config.API)
+	config.API = APIConfig{}
+	w := httptest.NewRecorder()
+	apiRouter().ServeHTTP(w, httptest.NewRequest("GET", "/v1/config", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("open api = %d, expected %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestRedactApp(t *testing.T) {
+	defer func(old []*regexp.Regexp) { redactPatterns = old }(redactPatterns)
+	redactPatterns = []*regexp.Regexp{regexp.MustCompile("(?i)(password|secret)")}
+	app := App{
+		Env:    map[string]string{"DB_PASSWORD": "hunter2", "PORT": "8080"},
+		Labels: map[string]string{"API_SECRET": "s3cret", "NIXY_REALM": "public"},
+		Tasks:  []Task{{ID: "app.1", Labels: map[string]string{"secret": "x", "team": "ops"}}},
+	}
+	got := redactApp(app)
+	want := App{
+		Env:    map[string]string{"DB_PASSWORD": "REDACTED", "PORT": "8080"},
+		Labels: map[string]string{"API_SECRET": "REDACTED", "NIXY_REALM": "public"},
+		Tasks:  []Task{{ID: "app.1", Labels: map[string]string{"secret": "REDACTED", "team": "ops"}}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("redactApp = %+v, expected %+v", got, want)
+	}
+	// the app itself is not changed.
+	if app.Env["DB_PASSWORD"] != "hunter2" || app.Tasks[0].Labels["secret"] != "x" {
+		t.Error("redactApp changed the original app")
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// AppInfo is an app as returned by the apps API.
+type AppInfo struct {
+	ID string
+	App
+	Excluded []Exclusion `json:",omitempty"`
+}
+
+// AppList is a page of apps.
+type AppList struct {
+	Total   int
+	Page    int
+	PerPage int
+	Apps    []AppInfo
+}
+
+// matchesApp checks an app against the realm, host and label filters of a
+// request. Labels are filtered by key, or key=value.
+func matchesApp(app App, query map[string][]string) bool {
+	if realm := query["realm"]; len(realm) > 0 && app.Labels["NIXY_REALM"] != realm[0] {
+		return false
+	}
+	if host := query["host"]; len(host) > 0 {
+		found := false
+		for _, h := range app.Hosts {
+			if h == host[0] {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, l := range query["label"] {
+		kv := strings.SplitN(l, "=", 2)
+		value, ok := app.Labels[kv[0]]
+		if !ok || (len(kv) == 2 && value != kv[1]) {
+			return false
+		}
+	}
+	return true
+}
+
+func queryInt(r *http.Request, name string, def int) int {
+	i, err := strconv.Atoi(r.URL.Query().Get(name))
+	if err != nil || i < 1 {
+		return def
+	}
+	return i
+}
+
+func nixyApps(w http.ResponseWriter, r *http.Request) {
+	page := queryInt(r, "page", 1)
+	perPage := queryInt(r, "per_page", 100)
+	if perPage > 1000 {
+		perPage = 1000
+	}
+	query := r.URL.Query()
+	config.RLock()
+	var ids []string
+	for id, app := range config.Apps {
+		if matchesApp(app, query) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	list := AppList{
+		Total:   len(ids),
+		Page:    page,
+		PerPage: perPage,
+		Apps:    []AppInfo{},
+	}
+	start := (page - 1) * perPage
+	for i := start; i < len(ids) && i < start+perPage; i++ {
+		excluded, _ := exclusions.get(ids[i])
+		list.Apps = append(list.Apps, AppInfo{ID: ids[i], App: redactApp(config.Apps[ids[i]]), Excluded: excluded})
+	}
+	b, _ := json.MarshalIndent(&list, "", "  ")
+	config.RUnlock()
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	w.Write(b)
+	return
+}
+
+func nixyApp(w http.ResponseWriter, r *http.Request) {
+	id := "/" + strings.Trim(mux.Vars(r)["id"], "/")
+	excluded, known := exclusions.get(id)
+	config.RLock()
+	app, ok := config.Apps[id]
+	config.RUnlock()
+	// apps without any routed task are still known by their exclusions.
+	if !ok && !known {
+		http.Error(w, "app not found", http.StatusNotFound)
+		return
+	}
+	info := AppInfo{ID: id, App: redactApp(app), Excluded: excluded}
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	b, _ := json.MarshalIndent(&info, "", "  ")
+	w.Write(b)
+	return
+}
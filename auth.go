@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Authenticator adds credentials to requests sent to Marathon.
+type Authenticator interface {
+	// Authenticate sets the credentials on the request.
+	Authenticate(req *http.Request) error
+	// Invalidate drops cached credentials after Marathon rejected them.
+	Invalidate()
+}
+
+// DCOSConfig settings for DC/OS service account authentication.
+type DCOSConfig struct {
+	UID            string
+	PrivateKeyFile string `toml:"private_key_file"`
+	LoginEndpoint  string `toml:"login_endpoint"`
+	SecretFile     string `toml:"secret_file"`
+}
+
+// DCOSSecret is the service account secret as created by the dcos cli.
+type DCOSSecret struct {
+	Scheme        string `json:"scheme"`
+	UID           string `json:"uid"`
+	PrivateKey    string `json:"private_key"`
+	LoginEndpoint string `json:"login_endpoint"`
+}
+
+var auth Authenticator = &basicAuth{}
+
+// basicAuth uses HTTP basic auth, or nothing at all if no user is set. The
+// user of an endpoint url is used for the leader resolved from it.
+type basicAuth struct {
+	user string
+	pass string
+}
+
+func (a *basicAuth) Authenticate(req *http.Request) error {
+	if a.user != "" {
+		req.SetBasicAuth(a.user, a.pass)
+		return nil
+	}
+	if u := leaderUser(req.URL.Host); u != nil && req.URL.User == nil {
+		pass, _ := u.Password()
+		req.SetBasicAuth(u.Username(), pass)
+	}
+	return nil
+}
+
+func (a *basicAuth) Invalidate() {}
+
+// acsAuth logs in to the DC/OS ACS with a service account and sends the
+// received token with every request, renewing it before it expires.
+type acsAuth struct {
+	sync.Mutex
+	uid           string
+	key           *rsa.PrivateKey
+	loginEndpoint string
+	token         string
+	expires       time.Time
+}
+
+// Renew tokens this long before they expire.
+const acsRenewMargin = 5 * time.Minute
+
+func (a *acsAuth) Authenticate(req *http.Request) error {
+	a.Lock()
+	defer a.Unlock()
+	if a.token == "" || (!a.expires.IsZero() && time.Now().Add(acsRenewMargin).After(a.expires)) {
+		err := a.login()
+		if err != nil {
+			go countAuthErrors.Inc()
+			return err
+		}
+	}
+	req.Header.Set("Authorization", "token="+a.token)
+	return nil
+}
+
+func (a *acsAuth) Invalidate() {
+	a.Lock()
+	a.token = ""
+	a.Unlock()
+}
+
+func (a *acsAuth) login() error {
+	assertion, err := a.loginToken()
+	if err != nil {
+		return err
+	}
+	body, _ := json.Marshal(map[string]string{
+		"uid":   a.uid,
+		"token": assertion,
+	})
+	client := &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: tr,
+	}
+	req, err := http.NewRequest("POST", a.loginEndpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("dcos login failed: " + resp.Status)
+	}
+	var login struct {
+		Token string `json:"token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&login)
+	if err != nil {
+		return err
+	}
+	if login.Token == "" {
+		return errors.New("dcos login returned no token")
+	}
+	a.token = login.Token
+	a.expires = tokenExpiry(login.Token)
+	logger.WithFields(logrus.Fields{
+		"uid":     a.uid,
+		"expires": a.expires,
+	}).Info("logged in to dcos")
+	return nil
+}
+
+// loginToken creates the short lived RS256 JWT used to log in.
+func (a *acsAuth) loginToken() (string, error) {
+	enc := base64.RawURLEncoding
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"uid": a.uid,
+		"exp": time.Now().Add(5 * time.Minute).Unix(),
+	})
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
+
+// tokenExpiry reads the exp claim of a JWT without verifying it, a zero
+// time means the token is only renewed when Marathon rejects it.
+func tokenExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if json.Unmarshal(payload, &claims) != nil || claims.Exp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(claims.Exp, 0)
+}
+
+func parsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found in private key")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not an RSA key")
+	}
+	return key, nil
+}
+
+func setupAuth() (Authenticator, error) {
+	c := config.DCOS
+	if c.SecretFile == "" && c.UID == "" {
+		return &basicAuth{user: config.User, pass: config.Pass}, nil
+	}
+	var pemKey []byte
+	if c.SecretFile != "" {
+		file, err := ioutil.ReadFile(c.SecretFile)
+		if err != nil {
+			return nil, err
+		}
+		secret := DCOSSecret{}
+		err = json.Unmarshal(file, &secret)
+		if err != nil {
+			return nil, err
+		}
+		if secret.Scheme != "" && secret.Scheme != "RS256" {
+			return nil, errors.New("unsupported service account scheme " + secret.Scheme)
+		}
+		if c.UID == "" {
+			c.UID = secret.UID
+		}
+		if c.LoginEndpoint == "" {
+			c.LoginEndpoint = secret.LoginEndpoint
+		}
+		pemKey = []byte(secret.PrivateKey)
+	}
+	if c.PrivateKeyFile != "" {
+		file, err := ioutil.ReadFile(c.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		pemKey = file
+	}
+	if c.UID == "" || c.LoginEndpoint == "" || len(pemKey) == 0 {
+		return nil, errors.New("dcos auth needs uid, private key and login_endpoint")
+	}
+	key, err := parsePrivateKey(pemKey)
+	if err != nil {
+		return nil, err
+	}
+	return &acsAuth{
+		uid:           c.UID,
+		key:           key,
+		loginEndpoint: c.LoginEndpoint,
+	}, nil
+}
+
+// marathonDo authenticates and sends a request to Marathon. A request
+// rejected with 401 is sent once more with fresh credentials.
+func marathonDo(client *http.Client, req *http.Request) (*http.Response, error) {
+	err := auth.Authenticate(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	resp.Body.Close()
+	logger.WithFields(logrus.Fields{
+		"url": req.URL.String(),
+	}).Warn("marathon rejected credentials, authenticating again")
+	auth.Invalidate()
+	err = auth.Authenticate(req)
+	if err != nil {
+		return nil, err
+	}
+	return client.Do(req)
+}
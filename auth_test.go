@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeACS is a DC/OS login endpoint that checks the login token and hands
+// out numbered tokens expiring after ttl.
+type fakeACS struct {
+	sync.Mutex
+	key    *rsa.PublicKey
+	ttl    time.Duration
+	logins int
+}
+
+func (f *fakeACS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var login struct {
+		UID   string `json:"uid"`
+		Token string `json:"token"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&login)
+	if err != nil || login.UID != "nixy" {
+		http.Error(w, "bad login", http.StatusBadRequest)
+		return
+	}
+	parts := strings.Split(login.Token, ".")
+	sig, _ := base64.RawURLEncoding.DecodeString(parts[len(parts)-1])
+	hash := sha256.Sum256([]byte(strings.Join(parts[:len(parts)-1], ".")))
+	if len(parts) != 3 || rsa.VerifyPKCS1v15(f.key, crypto.SHA256, hash[:], sig) != nil {
+		http.Error(w, "bad signature", http.StatusUnauthorized)
+		return
+	}
+	f.Lock()
+	f.logins++
+	token := fakeJWT(fmt.Sprintf("token-%d", f.logins), time.Now().Add(f.ttl))
+	f.Unlock()
+	json.NewEncoder(w).Encode(map[string]string{"token": token})
+}
+
+func (f *fakeACS) count() int {
+	f.Lock()
+	defer f.Unlock()
+	return f.logins
+}
+
+// fakeJWT returns an unsigned JWT with a subject and exp claim.
+func fakeJWT(sub string, exp time.Time) string {
+	enc := base64.RawURLEncoding
+	claims, _ := json.Marshal(map[string]interface{}{"sub": sub, "exp": exp.Unix()})
+	return enc.EncodeToString([]byte(`{"alg":"none"}`)) + "." + enc.EncodeToString(claims) + ".sig"
+}
+
+func newFakeACS(t *testing.T, ttl time.Duration) (*acsAuth, *fakeACS, *httptest.Server) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acs := &fakeACS{key: &key.PublicKey, ttl: ttl}
+	server := httptest.NewServer(acs)
+	return &acsAuth{uid: "nixy", key: key, loginEndpoint: server.URL}, acs, server
+}
+
+func TestACSAuthLogin(t *testing.T) {
+	a, acs, server := newFakeACS(t, time.Hour)
+	defer server.Close()
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", "http://marathon/v2/apps", nil)
+		err := a.Authenticate(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h := req.Header.Get("Authorization"); !strings.HasPrefix(h, "token=") {
+			t.Errorf("Authorization = %q, expected a token", h)
+		}
+	}
+	if acs.count() != 1 {
+		t.Errorf("logged in %d times, expected the token to be reused", acs.count())
+	}
+	if a.expires.Before(time.Now().Add(50 * time.Minute)) {
+		t.Errorf("token expires %v, expected it read from the token", a.expires)
+	}
+}
+
+func TestACSAuthRenewal(t *testing.T) {
+	// tokens expiring within the renew margin are renewed on every request.
+	a, acs, server := newFakeACS(t, acsRenewMargin/2)
+	defer server.Close()
+	req, _ := http.NewRequest("GET", "http://marathon/v2/apps", nil)
+	a.Authenticate(req)
+	first := req.Header.Get("Authorization")
+	a.Authenticate(req)
+	if acs.count() != 2 {
+		t.Errorf("logged in %d times, expected a renewal", acs.count())
+	}
+	if req.Header.Get("Authorization") == first {
+		t.Error("token not renewed")
+	}
+}
+
+func TestACSAuthLoginFailure(t *testing.T) {
+	a, _, server := newFakeACS(t, time.Hour)
+	defer server.Close()
+	other, _ := rsa.GenerateKey(rand.Reader, 1024)
+	a.key = other
+	req, _ := http.NewRequest("GET", "http://marathon/v2/apps", nil)
+	err := a.Authenticate(req)
+	if err == nil {
+		t.Error("login with the wrong key succeeded")
+	}
+}
+
+func TestMarathonDoRetriesUnauthorized(t *testing.T) {
+	a, acs, server := newFakeACS(t, time.Hour)
+	defer server.Close()
+	defer func(old Authenticator) { auth = old }(auth)
+	auth = a
+	var requests int
+	var tokens []string
+	marathon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		tokens = append(tokens, r.Header.Get("Authorization"))
+		// the first token was revoked, later ones are accepted.
+		if requests == 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintln(w, "{}")
+	}))
+	defer marathon.Close()
+	req, _ := http.NewRequest("GET", marathon.URL+"/v2/apps", nil)
+	resp, err := marathonDo(http.DefaultClient, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status %d, expected the retry to succeed", resp.StatusCode)
+	}
+	if requests != 2 || acs.count() != 2 {
+		t.Errorf("%d requests and %d logins, expected 2 of each", requests, acs.count())
+	}
+	if len(tokens) == 2 && tokens[0] == tokens[1] {
+		t.Error("retry sent the rejected token")
+	}
+}
+
+func TestMarathonDoGivesUpAfterRetry(t *testing.T) {
+	a, acs, server := newFakeACS(t, time.Hour)
+	defer server.Close()
+	defer func(old Authenticator) { auth = old }(auth)
+	auth = a
+	var requests int
+	marathon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer marathon.Close()
+	req, _ := http.NewRequest("GET", marathon.URL+"/v2/apps", nil)
+	resp, err := marathonDo(http.DefaultClient, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized || requests != 2 || acs.count() != 2 {
+		t.Errorf("status %d after %d requests and %d logins, expected 401 after a single retry", resp.StatusCode, requests, acs.count())
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// commands of the nixy binary, nixy without a command serves.
+var commands map[string]func(args []string) int
+
+func init() {
+	commands = map[string]func(args []string) int{
+		"serve":    serveCmd,
+		"validate": validateCmd,
+		"render":   renderCmd,
+		"check":    checkCmd,
+		"apps":     appsCmd,
+		"version":  versionCmd,
+		"help":     helpCmd,
+	}
+}
+
+func usage() {
+	fmt.Fprint(os.Stderr, `Usage: nixy [command] [flags]
+
+Commands:
+  serve     run nixy, the default without a command
+  validate  check the config, templates and rendered nginx config
+  render    render a template with the apps of a state snapshot
+  check     nagios check of a running nixy
+  apps      list the apps routed by a running nixy
+  version   print the nixy version
+
+Run "nixy <command> -h" for the flags of a command.
+`)
+}
+
+func helpCmd(args []string) int {
+	usage()
+	return 0
+}
+
+func versionCmd(args []string) int {
+	fmt.Printf("version: %s\n", version)
+	fmt.Printf("commit: %s\n", commit)
+	fmt.Printf("date: %s\n", date)
+	return 0
+}
+
+// validateCmd parses the config and templates, renders them with the apps
+// of the state snapshot if there is one, and checks the main config.
+func validateCmd(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	configtoml := flags.String("f", "nixy.toml", "Path to config.")
+	state := flags.String("state", "", "State snapshot with the apps to render, defaults to state_file.")
+	flags.Parse(args)
+	err := loadConfig(*configtoml)
+	if err == nil {
+		proxy, err = setupProxy()
+	}
+	if err == nil {
+		_, err = setupUpstreams()
+	}
+	if err == nil {
+		_, err = newTransport(config.TLS)
+	}
+	if err == nil {
+		_, err = setupAuth()
+	}
+	if err == nil {
+		err = setupAPIAuth()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "config: "+err.Error())
+		return 1
+	}
+	fmt.Println("config: OK")
+	if *state != "" || config.StateFile != "" {
+		err = loadApps(*state)
+		if err != nil && !(*state == "" && os.IsNotExist(err)) {
+			fmt.Fprintln(os.Stderr, "state: "+err.Error())
+			return 1
+		}
+	}
+	files, err := renderConf()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "template: "+err.Error())
+		return 1
+	}
+	fmt.Printf("template: OK (%d apps)\n", len(config.Apps))
+	mainConfig := outputs()[0].Config
+	err = checkPreview(files[mainConfig], filepath.Dir(mainConfig))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "nginx config: "+err.Error())
+		return 1
+	}
+	fmt.Println("nginx config: OK")
+	return 0
+}
+
+// Nagios exit codes.
+const (
+	nagiosOK       = 0
+	nagiosWarning  = 1
+	nagiosCritical = 2
+)
+
+// checkCmd checks the health of a running nixy, for nagios.
+func checkCmd(args []string) int {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	healthURL := flags.String("url", "http://localhost:6000/v1/health", "Nixy health API URL.")
+	flags.StringVar(healthURL, "u", *healthURL, "Alias for -url.")
+	timeout := flags.Duration("timeout", 10*time.Second, "Timeout of the health request.")
+	token := flags.String("token", os.Getenv("NIXY_TOKEN"), "API token, defaults to $NIXY_TOKEN.")
+	flags.Parse(args)
+	status, msg := checkHealth(*healthURL, *token, *timeout)
+	fmt.Println(msg)
+	return status
+}
+
+func checkHealth(healthURL string, token string, timeout time.Duration) (int, string) {
+	resp, err := apiGet(healthURL, token, timeout)
+	if err != nil {
+		return nagiosCritical, "NIXY CRITICAL - " + err.Error()
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return nagiosCritical, "NIXY CRITICAL - " + resp.Status + ", check the api token"
+	}
+	// an unhealthy nixy answers with 500, the body tells why.
+	health := Health{}
+	err = json.NewDecoder(resp.Body).Decode(&health)
+	if err != nil {
+		return nagiosCritical, "NIXY CRITICAL - " + resp.Status + ": " + err.Error()
+	}
+	total := len(health.Endpoints)
+	sick := 0
+	for _, endpoint := range health.Endpoints {
+		if !endpoint.Healthy {
+			sick++
+		}
+	}
+	perfdata := fmt.Sprintf(" | endpoints=%d;;;0 endpoints_down=%d;;;0;%d", total, sick, total)
+	switch {
+	case !health.Config.Healthy:
+		return nagiosCritical, "NIXY CRITICAL - " + health.Config.Message + perfdata
+	case !health.Template.Healthy:
+		return nagiosCritical, "NIXY CRITICAL - " + health.Template.Message + perfdata
+	case !health.Reload.Healthy && health.Reload.Message != "":
+		return nagiosCritical, "NIXY CRITICAL - " + health.Reload.Message + perfdata
+	case total > 0 && sick == total:
+		return nagiosCritical, "NIXY CRITICAL - All Marathon endpoints are down" + perfdata
+	case sick > 0:
+		return nagiosWarning, fmt.Sprintf("NIXY WARNING - %d/%d Marathon endpoints are down. Check %s for details.", sick, total, healthURL) + perfdata
+	case health.Snapshot != nil && health.Snapshot.Stale:
+		return nagiosWarning, "NIXY WARNING - serving apps from the state snapshot of " + health.Snapshot.Timestamp.Format(time.RFC3339) + perfdata
+	}
+	return nagiosOK, "NIXY OK" + perfdata
+}
+
+// appsCmd lists the apps of a running nixy.
+func appsCmd(args []string) int {
+	flags := flag.NewFlagSet("apps", flag.ExitOnError)
+	base := flags.String("url", "http://localhost:6000", "Nixy URL.")
+	realm := flags.String("realm", "", "Only apps of this realm.")
+	host := flags.String("host", "", "Only apps with this host.")
+	label := flags.String("label", "", "Only apps with this label, as KEY or KEY=VALUE.")
+	jsonOutput := flags.Bool("json", false, "Print the apps as JSON.")
+	token := flags.String("token", os.Getenv("NIXY_TOKEN"), "API token, defaults to $NIXY_TOKEN.")
+	flags.Parse(args)
+	if id := flags.Arg(0); id != "" {
+		return printApp(*base, *token, id)
+	}
+	query := url.Values{}
+	if *realm != "" {
+		query.Set("realm", *realm)
+	}
+	if *host != "" {
+		query.Set("host", *host)
+	}
+	if *label != "" {
+		query.Set("label", *label)
+	}
+	var apps []AppInfo
+	for page := 1; ; page++ {
+		query.Set("page", strconv.Itoa(page))
+		list := AppList{}
+		err := getJSON(*base+"/v1/apps?"+query.Encode(), *token, &list)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+		apps = append(apps, list.Apps...)
+		if len(list.Apps) == 0 || len(apps) >= list.Total {
+			break
+		}
+	}
+	if *jsonOutput {
+		b, _ := json.MarshalIndent(apps, "", "  ")
+		fmt.Println(string(b))
+		return 0
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tHOSTS\tTASKS\tEXCLUDED")
+	for _, app := range apps {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\n", app.ID, strings.Join(app.Hosts, ","), len(app.Tasks), len(app.Excluded))
+	}
+	w.Flush()
+	return 0
+}
+
+// printApp prints a single app with its tasks and exclusions.
+func printApp(base string, token string, id string) int {
+	app := AppInfo{}
+	err := getJSON(base+"/v1/apps/"+strings.TrimPrefix(id, "/"), token, &app)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	fmt.Printf("ID:     %s\n", app.ID)
+	fmt.Printf("Hosts:  %s\n", strings.Join(app.Hosts, ", "))
+	fmt.Println("Tasks:")
+	for _, task := range app.Tasks {
+		fmt.Printf("  %s %s:%d\n", task.ID, task.Address, task.Port)
+	}
+	if len(app.Excluded) > 0 {
+		fmt.Println("Excluded:")
+		for _, ex := range app.Excluded {
+			what := "app"
+			if ex.Task != "" {
+				what = ex.Task
+			}
+			detail := ex.Reason
+			if ex.Detail != "" {
+				detail += " (" + ex.Detail + ")"
+			}
+			fmt.Printf("  %s: %s\n", what, detail)
+		}
+	}
+	return 0
+}
+
+// apiGet requests the API of a running nixy, with a bearer token if set.
+func apiGet(u string, token string, timeout time.Duration) (*http.Response, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	client := &http.Client{Timeout: timeout}
+	return client.Do(req)
+}
+
+func getJSON(u string, token string, v interface{}) error {
+	resp, err := apiGet(u, token, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return errors.New(resp.Status + ": " + strings.TrimSpace(string(b)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// lcs is the length of the longest common subsequence, a shortest edit
+// script keeps exactly that many lines.
+func lcs(a, b []string) int {
+	l := make([][]int, len(a)+1)
+	for i := range l {
+		l[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				l[i][j] = l[i+1][j+1] + 1
+			} else if l[i+1][j] > l[i][j+1] {
+				l[i][j] = l[i+1][j]
+			} else {
+				l[i][j] = l[i][j+1]
+			}
+		}
+	}
+	return l[0][0]
+}
+
+func checkDiff(t *testing.T, a, b []string) {
+	ops := diffLines(a, b)
+	var gotA, gotB []string
+	kept := 0
+	for _, op := range ops {
+		switch op.kind {
+		case ' ':
+			gotA = append(gotA, op.line)
+			gotB = append(gotB, op.line)
+			kept++
+		case '-':
+			gotA = append(gotA, op.line)
+		case '+':
+			gotB = append(gotB, op.line)
+		default:
+			t.Fatalf("unknown op %q", op.kind)
+		}
+	}
+	if strings.Join(gotA, "\n") != strings.Join(a, "\n") || strings.Join(gotB, "\n") != strings.Join(b, "\n") {
+		t.Errorf("diff of %v and %v does not give back both sides: %v", a, b, ops)
+	}
+	if want := lcs(a, b); kept != want {
+		t.Errorf("diff of %v and %v keeps %d lines, expected %d", a, b, kept, want)
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		a, b string
+	}{
+		{"", ""},
+		{"a", ""},
+		{"", "a"},
+		{"a", "a"},
+		{"a b c", "a b c"},
+		{"a b c", "a c"},
+		{"a c", "a b c"},
+		{"a b c a b b a", "c b a b a c"},
+		{"x a b c", "a b c y"},
+		{"a b c", "d e f"},
+	}
+	for _, test := range tests {
+		checkDiff(t, strings.Fields(test.a), strings.Fields(test.b))
+	}
+}
+
+func TestDiffLinesRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	lines := func() []string {
+		s := make([]string, r.Intn(20))
+		for i := range s {
+			s[i] = string('a' + rune(r.Intn(4)))
+		}
+		return s
+	}
+	for i := 0; i < 500; i++ {
+		checkDiff(t, lines(), lines())
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	a := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n"
+	b := "1\n2\nthree\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n"
+	want := strings.Join([]string{
+		"--- a",
+		"+++ b",
+		"@@ -1,6 +1,6 @@",
+		" 1",
+		" 2",
+		"-3",
+		"+three",
+		" 4",
+		" 5",
+		" 6",
+		"@@ -10,3 +10,4 @@",
+		" 10",
+		" 11",
+		" 12",
+		"+13",
+		"",
+	}, "\n")
+	if got := unifiedDiff(a, b, "a", "b"); got != want {
+		t.Errorf("unifiedDiff =\n%s\nexpected\n%s", got, want)
+	}
+	if got := unifiedDiff(a, a, "a", "b"); got != "" {
+		t.Errorf("unifiedDiff of equal texts = %q", got)
+	}
+	// changes close together share a hunk.
+	got := unifiedDiff("1\n2\n3\n4\n5\n", "x\n2\n3\n4\ny\n", "a", "b")
+	if strings.Count(got, "@@ -") != 1 {
+		t.Errorf("unifiedDiff split close changes:\n%s", got)
+	}
+	if got := unifiedDiff("", "a\n", "a", "b"); got != "--- a\n+++ b\n@@ -0,0 +1,1 @@\n+a\n" {
+		t.Errorf("unifiedDiff of a new file = %q", got)
+	}
+}
+
+func TestSplitLines(t *testing.T) {
+	if got := splitLines("a\nb\n"); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("splitLines = %q", got)
+	}
+	if got := splitLines(""); got != nil {
+		t.Errorf("splitLines of empty = %q", got)
+	}
+}
+
+func TestDiffLinesLarge(t *testing.T) {
+	// every other line changed, too many edits for a shortest edit script.
+	var a, b []string
+	for i := 0; i < 10000; i++ {
+		a = append(a, "    server 10.0.0.1:"+strings.Repeat("1", i%7))
+		if i%2 == 0 {
+			b = append(b, "    server 10.0.0.2:"+strings.Repeat("2", i%7))
+		} else {
+			b = append(b, a[i])
+		}
+	}
+	a = append([]string{"http {"}, append(a, "}")...)
+	b = append([]string{"http {"}, append(b, "}")...)
+	ops := diffLines(a, b)
+	var gotA, gotB []string
+	for _, op := range ops {
+		if op.kind != '+' {
+			gotA = append(gotA, op.line)
+		}
+		if op.kind != '-' {
+			gotB = append(gotB, op.line)
+		}
+	}
+	if !reflect.DeepEqual(gotA, a) || !reflect.DeepEqual(gotB, b) {
+		t.Error("diff does not give back both sides")
+	}
+	if ops[0] != (diffOp{' ', "http {"}) || ops[len(ops)-1] != (diffOp{' ', "}"}) {
+		t.Error("common first and last lines not kept")
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// MarathonEvent struct for the event stream payloads we know how to apply.
+type MarathonEvent struct {
+	EventType     string              `json:"eventType"`
+	Timestamp     string              `json:"timestamp"`
+	AppID         string              `json:"appId"`
+	RunSpecID     string              `json:"runSpecId"`
+	TaskID        string              `json:"taskId"`
+	InstanceID    string              `json:"instanceId"`
+	TaskStatus    string              `json:"taskStatus"`
+	Host          string              `json:"host"`
+	SlaveID       string              `json:"slaveId"`
+	Ports         []int64             `json:"ports"`
+	IPAddresses   []MarathonIPAddress `json:"ipAddresses"`
+	Version       string              `json:"version"`
+	Alive         bool                `json:"alive"`
+	AppDefinition struct {
+		ID string `json:"id"`
+	} `json:"appDefinition"`
+	Plan struct {
+		Steps []struct {
+			Actions []struct {
+				Action string `json:"action"`
+				App    string `json:"app"`
+			} `json:"actions"`
+		} `json:"steps"`
+	} `json:"plan"`
+}
+
+// AppState keeps the last known Marathon apps in memory, so events can be
+// applied as deltas instead of fetching all apps from Marathon every time.
+type AppState struct {
+	sync.Mutex
+	apps       map[string]MarathonApp
+	pending    map[string]bool
+	resync     bool
+	lastResync time.Time
+	recording  bool
+	backlog    []MarathonEvent
+}
+
+// Task states where Marathon will not bring the task back.
+var terminalTaskStates = map[string]bool{
+	"TASK_FINISHED":         true,
+	"TASK_FAILED":           true,
+	"TASK_KILLED":           true,
+	"TASK_LOST":             true,
+	"TASK_ERROR":            true,
+	"TASK_DROPPED":          true,
+	"TASK_GONE":             true,
+	"TASK_GONE_BY_OPERATOR": true,
+}
+
+var errDeltaNotApplicable = errors.New("event can not be applied to known state")
+
+var state = AppState{pending: make(map[string]bool)}
+
+// forceResync makes the next reload fetch all apps from Marathon.
+func (s *AppState) forceResync() {
+	s.Lock()
+	s.resync = true
+	s.Unlock()
+}
+
+// applyEvent updates the known state with a single event. Whatever can not
+// be applied directly is marked for a refetch on the next reload.
+func (s *AppState) applyEvent(ev MarathonEvent) {
+	s.Lock()
+	defer s.Unlock()
+	if s.recording {
+		// a fetch is running, replay this once its result is in place.
+		s.backlog = append(s.backlog, ev)
+	}
+	s.apply(ev)
+}
+
+func (s *AppState) apply(ev MarathonEvent) {
+	if s.apps == nil {
+		s.resync = true
+		return
+	}
+	var err error
+	switch ev.EventType {
+	case "status_update_event":
+		err = s.applyStatusUpdate(ev)
+	case "health_status_changed_event":
+		err = s.applyHealthStatus(ev)
+	case "app_terminated_event":
+		delete(s.apps, ev.AppID)
+	default:
+		ids := ev.appIDs()
+		if len(ids) == 0 {
+			// nothing tells us which apps are involved, fetch them all.
+			s.resync = true
+			return
+		}
+		for _, id := range ids {
+			s.pending[id] = true
+		}
+		return
+	}
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"event": ev.EventType,
+			"app":   ev.AppID,
+			"error": err.Error(),
+		}).Debug("unable to apply event, app will be fetched")
+		go countMarathonDeltasFailed.Inc()
+		s.pending[ev.AppID] = true
+		return
+	}
+	go countMarathonDeltasApplied.Inc()
+}
+
+func (s *AppState) applyStatusUpdate(ev MarathonEvent) error {
+	app, ok := s.apps[ev.AppID]
+	if !ok || app.pod {
+		return errDeltaNotApplicable
+	}
+	tasks := make([]MarathonTask, 0, len(app.Tasks)+1)
+	var found bool
+	for _, task := range app.Tasks {
+		if task.ID != ev.TaskID {
+			tasks = append(tasks, task)
+			continue
+		}
+		found = true
+		if terminalTaskStates[ev.TaskStatus] {
+			continue
+		}
+		task.State = ev.TaskStatus
+		task.Host = ev.Host
+		task.Ports = ev.Ports
+		task.IPAddresses = ev.IPAddresses
+		task.SlaveID = ev.SlaveID
+		task.Version = ev.Version
+		if ev.TaskStatus == "TASK_RUNNING" && task.StartedAt == "" {
+			task.StartedAt = ev.Timestamp
+		}
+		tasks = append(tasks, task)
+	}
+	if !found && !terminalTaskStates[ev.TaskStatus] {
+		task := MarathonTask{
+			AppID:        ev.AppID,
+			Host:         ev.Host,
+			ID:           ev.TaskID,
+			Ports:        ev.Ports,
+			IPAddresses:  ev.IPAddresses,
+			ServicePorts: app.servicePorts(),
+			SlaveID:      ev.SlaveID,
+			StagedAt:     ev.Timestamp,
+			State:        ev.TaskStatus,
+			Version:      ev.Version,
+		}
+		if ev.TaskStatus == "TASK_RUNNING" {
+			task.StartedAt = ev.Timestamp
+		}
+		tasks = append(tasks, task)
+	}
+	app.Tasks = tasks
+	s.apps[ev.AppID] = app
+	return nil
+}
+
+func (s *AppState) applyHealthStatus(ev MarathonEvent) error {
+	app, ok := s.apps[ev.AppID]
+	if !ok || app.pod {
+		return errDeltaNotApplicable
+	}
+	// we can not tell which health check changed, so only single checks are safe.
+	if len(app.HealthChecks) > 1 {
+		return errDeltaNotApplicable
+	}
+	for i, task := range app.Tasks {
+		if !ev.matchesTask(task.ID) {
+			continue
+		}
+		app.Tasks[i].HealthCheckResults = []MarathonHealthCheckResult{{Alive: ev.Alive}}
+		s.apps[ev.AppID] = app
+		return nil
+	}
+	return errDeltaNotApplicable
+}
+
+// servicePorts returns the service ports of the app, taken from a running
+// task when possible.
+func (app MarathonApp) servicePorts() []int64 {
+	for _, task := range app.Tasks {
+		if len(task.ServicePorts) > 0 {
+			return task.ServicePorts
+		}
+	}
+	var ports []int64
+	for _, pd := range app.PortDefinitions {
+		ports = append(ports, pd.Port)
+	}
+	for _, pm := range app.portMappings() {
+		ports = append(ports, pm.ServicePort)
+	}
+	return ports
+}
+
+// matchesTask compares both task ids and instance ids, newer versions of
+// Marathon only send the instance id in health events.
+func (ev MarathonEvent) matchesTask(id string) bool {
+	if ev.TaskID != "" {
+		return ev.TaskID == id
+	}
+	if ev.InstanceID != "" {
+		return id == ev.InstanceID || strings.HasPrefix(id, ev.InstanceID+".")
+	}
+	return false
+}
+
+// appIDs returns all app ids an event refers to.
+func (ev MarathonEvent) appIDs() []string {
+	seen := make(map[string]bool)
+	var ids []string
+	add := func(id string) {
+		if id != "" && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	add(ev.AppID)
+	add(ev.RunSpecID)
+	add(ev.AppDefinition.ID)
+	for _, step := range ev.Plan.Steps {
+		for _, action := range step.Actions {
+			add(action.App)
+		}
+	}
+	return ids
+}
+
+// refreshApps brings the known state up to date with Marathon and returns
+// a copy of it. All apps are fetched on the first run, when forced, when
+// the resync interval has passed or if a previous fetch failed. Otherwise
+// only the apps marked by events are fetched.
+func refreshApps() (*MarathonApps, error) {
+	state.Lock()
+	full := state.resync || state.apps == nil ||
+		time.Since(state.lastResync) > config.ResyncInterval.Duration
+	pending := state.pending
+	state.pending = make(map[string]bool)
+	state.resync = false
+	state.recording = true
+	state.backlog = nil
+	state.Unlock()
+
+	fetched := make(map[string]MarathonApp)
+	removed := make(map[string]bool)
+	var err error
+	if full {
+		err = fetchAllApps(fetched)
+	} else {
+		for id := range pending {
+			var app *MarathonApp
+			app, err = fetchApp(id)
+			if err != nil {
+				break
+			}
+			if app == nil {
+				removed[id] = true
+				continue
+			}
+			fetched[id] = *app
+		}
+	}
+
+	state.Lock()
+	defer state.Unlock()
+	state.recording = false
+	if err != nil {
+		resetLeader()
+		state.backlog = nil
+		if full {
+			state.resync = true
+		}
+		for id := range pending {
+			state.pending[id] = true
+		}
+		return nil, err
+	}
+	if full {
+		state.apps = fetched
+		state.lastResync = time.Now()
+		go countMarathonFullResyncs.Inc()
+	} else {
+		for id, app := range fetched {
+			state.apps[id] = app
+		}
+		for id := range removed {
+			delete(state.apps, id)
+		}
+	}
+	// events that arrived during the fetch may be newer than what we got.
+	for _, ev := range state.backlog {
+		state.apply(ev)
+	}
+	state.backlog = nil
+	return state.snapshot(), nil
+}
+
+// snapshot returns the known apps sorted by id, the same order as /v2/apps.
+func (s *AppState) snapshot() *MarathonApps {
+	ids := make([]string, 0, len(s.apps))
+	for id := range s.apps {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	jsonapps := &MarathonApps{}
+	for _, id := range ids {
+		app := s.apps[id]
+		app.Tasks = append([]MarathonTask(nil), app.Tasks...)
+		jsonapps.Apps = append(jsonapps.Apps, app)
+	}
+	return jsonapps
+}
+
+func fetchAllApps(apps map[string]MarathonApp) error {
+	jsonapps := MarathonApps{}
+	err := fetchApps(&jsonapps)
+	if err != nil {
+		return err
+	}
+	for _, app := range jsonapps.Apps {
+		apps[app.ID] = app
+	}
+	return fetchPods(apps)
+}
+
+// fetchApp fetches a single app or pod with its tasks, returns nil if it
+// does not exist anymore.
+func fetchApp(id string) (*MarathonApp, error) {
+	jsonapp := MarathonSingleApp{}
+	found, err := fetchJSON("/v2/apps/"+escapeID(id)+"?embed=app.tasks", &jsonapp)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		return &jsonapp.App, nil
+	}
+	return fetchPod(id)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func testState() *AppState {
+	return &AppState{
+		pending: make(map[string]bool),
+		apps: map[string]MarathonApp{
+			"/app": {
+				ID:           "/app",
+				HealthChecks: []MarathonHealthCheck{{Path: "/health"}},
+				Tasks: []MarathonTask{{
+					AppID:        "/app",
+					ID:           "app.1",
+					Host:         "agent1",
+					Ports:        []int64{31000},
+					ServicePorts: []int64{10000},
+					State:        "TASK_RUNNING",
+					StartedAt:    "2018-01-01T00:00:00.000Z",
+				}},
+			},
+			"/checks": {
+				ID:           "/checks",
+				HealthChecks: []MarathonHealthCheck{{Path: "/a"}, {Path: "/b"}},
+				Tasks:        []MarathonTask{{AppID: "/checks", ID: "checks.1", State: "TASK_RUNNING"}},
+			},
+			"/pod": {ID: "/pod", pod: true},
+		},
+	}
+}
+
+func parseEvent(t *testing.T, eventType, data string) MarathonEvent {
+	ev := MarathonEvent{}
+	err := json.Unmarshal([]byte(data), &ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev.EventType = eventType
+	return ev
+}
+
+func taskIDs(app MarathonApp) []string {
+	ids := []string{}
+	for _, task := range app.Tasks {
+		ids = append(ids, task.ID)
+	}
+	return ids
+}
+
+func TestApplyStatusUpdate(t *testing.T) {
+	s := testState()
+	s.apply(parseEvent(t, "status_update_event", `{"appId": "/app", "taskId": "app.2", "taskStatus": "TASK_STAGING", "host": "agent2", "ports": [31001], "timestamp": "2018-01-02T00:00:00.000Z"}`))
+	s.apply(parseEvent(t, "status_update_event", `{"appId": "/app", "taskId": "app.2", "taskStatus": "TASK_RUNNING", "host": "agent2", "ports": [31001], "timestamp": "2018-01-02T00:00:01.000Z"}`))
+	app := s.apps["/app"]
+	if !reflect.DeepEqual(taskIDs(app), []string{"app.1", "app.2"}) {
+		t.Fatalf("tasks %v, expected app.2 added", taskIDs(app))
+	}
+	task := app.Tasks[1]
+	if task.State != "TASK_RUNNING" || task.Host != "agent2" || task.StagedAt != "2018-01-02T00:00:00.000Z" || task.StartedAt != "2018-01-02T00:00:01.000Z" {
+		t.Errorf("task not updated: %+v", task)
+	}
+	if !reflect.DeepEqual(task.ServicePorts, []int64{10000}) {
+		t.Errorf("service ports %v, expected them from the other task", task.ServicePorts)
+	}
+	s.apply(parseEvent(t, "status_update_event", `{"appId": "/app", "taskId": "app.1", "taskStatus": "TASK_KILLED"}`))
+	if !reflect.DeepEqual(taskIDs(s.apps["/app"]), []string{"app.2"}) {
+		t.Errorf("tasks %v, expected app.1 removed", taskIDs(s.apps["/app"]))
+	}
+	// a terminal update of an unknown task changes nothing.
+	s.apply(parseEvent(t, "status_update_event", `{"appId": "/app", "taskId": "app.3", "taskStatus": "TASK_FAILED"}`))
+	if !reflect.DeepEqual(taskIDs(s.apps["/app"]), []string{"app.2"}) {
+		t.Errorf("tasks %v, expected only app.2", taskIDs(s.apps["/app"]))
+	}
+	if len(s.pending) != 0 || s.resync {
+		t.Errorf("pending %v, resync %v, expected all events applied", s.pending, s.resync)
+	}
+}
+
+func TestApplyHealthStatus(t *testing.T) {
+	s := testState()
+	s.apply(parseEvent(t, "health_status_changed_event", `{"appId": "/app", "taskId": "app.1", "alive": true}`))
+	results := s.apps["/app"].Tasks[0].HealthCheckResults
+	if !reflect.DeepEqual(results, []MarathonHealthCheckResult{{Alive: true}}) {
+		t.Errorf("health %v, expected alive", results)
+	}
+	// newer versions only send the instance id.
+	s.apply(parseEvent(t, "health_status_changed_event", `{"appId": "/app", "instanceId": "app", "alive": false}`))
+	results = s.apps["/app"].Tasks[0].HealthCheckResults
+	if !reflect.DeepEqual(results, []MarathonHealthCheckResult{{Alive: false}}) {
+		t.Errorf("health %v, expected not alive", results)
+	}
+	if len(s.pending) != 0 {
+		t.Errorf("pending %v, expected health events applied", s.pending)
+	}
+}
+
+func TestApplyNotApplicable(t *testing.T) {
+	tests := []struct {
+		name    string
+		event   string
+		data    string
+		pending []string
+		resync  bool
+	}{
+		{"unknown app", "status_update_event", `{"appId": "/new", "taskId": "new.1", "taskStatus": "TASK_RUNNING"}`, []string{"/new"}, false},
+		{"pod", "status_update_event", `{"appId": "/pod", "taskId": "pod.1", "taskStatus": "TASK_RUNNING"}`, []string{"/pod"}, false},
+		{"several health checks", "health_status_changed_event", `{"appId": "/checks", "taskId": "checks.1", "alive": true}`, []string{"/checks"}, false},
+		{"unknown task health", "health_status_changed_event", `{"appId": "/app", "taskId": "app.9", "alive": true}`, []string{"/app"}, false},
+		{"deployment", "deployment_info", `{"plan": {"steps": [{"actions": [{"action": "ScaleApplication", "app": "/app"}, {"action": "StartApplication", "app": "/new"}]}]}}`, []string{"/app", "/new"}, false},
+		{"app update", "api_post_event", `{"appDefinition": {"id": "/app"}}`, []string{"/app"}, false},
+		{"no app", "group_change_success", `{}`, []string{}, true},
+	}
+	for _, test := range tests {
+		s := testState()
+		s.apply(parseEvent(t, test.event, test.data))
+		pending := []string{}
+		for _, id := range []string{"/app", "/checks", "/new", "/pod"} {
+			if s.pending[id] {
+				pending = append(pending, id)
+			}
+		}
+		if !reflect.DeepEqual(pending, test.pending) || s.resync != test.resync {
+			t.Errorf("%s: pending %v, resync %v, expected %v, %v", test.name, pending, s.resync, test.pending, test.resync)
+		}
+	}
+}
+
+func TestApplyAppTerminated(t *testing.T) {
+	s := testState()
+	s.apply(parseEvent(t, "app_terminated_event", `{"appId": "/app"}`))
+	if _, ok := s.apps["/app"]; ok {
+		t.Error("app not removed")
+	}
+}
+
+func TestApplyWithoutState(t *testing.T) {
+	s := &AppState{pending: make(map[string]bool)}
+	s.apply(parseEvent(t, "status_update_event", `{"appId": "/app", "taskId": "app.1", "taskStatus": "TASK_RUNNING"}`))
+	if !s.resync {
+		t.Error("expected a resync before any apps are known")
+	}
+}
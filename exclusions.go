@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// Reasons a Marathon app or task is not routed.
+const (
+	reasonRealm              = "realm does not match"
+	reasonNoTasks            = "no routable tasks"
+	reasonInvalidSubdomain   = "invalid subdomain"
+	reasonDuplicateSubdomain = "duplicate subdomain"
+	reasonNoPorts            = "no ports"
+	reasonNoAddress          = "no host or ip address"
+	reasonNotRunning         = "not running"
+	reasonHealthUnknown      = "no health check results yet"
+	reasonUnhealthy          = "failing health checks"
+)
+
+// Exclusion is why an app, or a task of it if Task is set, is not routed.
+type Exclusion struct {
+	Task   string `json:",omitempty"`
+	State  string `json:",omitempty"`
+	Reason string
+	Detail string `json:",omitempty"`
+}
+
+// Exclusions of the last sync, keyed by app id.
+type Exclusions struct {
+	sync.RWMutex
+	apps map[string][]Exclusion
+}
+
+var exclusions = Exclusions{apps: make(map[string][]Exclusion)}
+
+// set replaces the exclusions after a sync and updates the gauge of
+// exclusions by reason.
+func (e *Exclusions) set(apps map[string][]Exclusion) {
+	e.Lock()
+	e.apps = apps
+	e.Unlock()
+	reasons := make(map[string]int)
+	for _, excluded := range apps {
+		for _, ex := range excluded {
+			reasons[ex.Reason]++
+		}
+	}
+	gaugeExclusions.Reset()
+	for reason, n := range reasons {
+		gaugeExclusions.WithLabelValues(reason).Set(float64(n))
+	}
+}
+
+func (e *Exclusions) get(id string) ([]Exclusion, bool) {
+	e.RLock()
+	defer e.RUnlock()
+	excluded, ok := e.apps[id]
+	return excluded, ok
+}
+
+func nixyExclusions(w http.ResponseWriter, r *http.Request) {
+	exclusions.RLock()
+	excluded := make(map[string][]Exclusion)
+	for id, ex := range exclusions.apps {
+		if len(ex) > 0 {
+			excluded[id] = ex
+		}
+	}
+	b, _ := json.MarshalIndent(excluded, "", "  ")
+	exclusions.RUnlock()
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	w.Write(b)
+	return
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// templateFuncs returns the functions available in templates.
+func templateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"hasPrefix":    strings.HasPrefix,
+		"hasSuffix":    strings.HasSuffix,
+		"contains":     strings.Contains,
+		"split":        strings.Split,
+		"join":         strings.Join,
+		"trim":         strings.Trim,
+		"replace":      strings.Replace,
+		"toLower":      strings.ToLower,
+		"toUpper":      strings.ToUpper,
+		"getenv":       os.Getenv,
+		"datetime":     time.Now,
+		"portByName":   portByName,
+		"default":      defaultValue,
+		"coalesce":     coalesce,
+		"regexMatch":   regexMatch,
+		"regexReplace": regexReplace,
+		"sort":         sortList,
+		"uniq":         uniq,
+		"dict":         dict,
+		"list":         list,
+		"sha256":       sha256Hex,
+		"base64":       base64Encode,
+		"base64Decode": base64Decode,
+		"int":          toInt,
+		"add":          add,
+		"sub":          sub,
+		"mul":          mul,
+		"div":          div,
+		"mod":          mod,
+		"max":          maxInt,
+		"min":          minInt,
+		"toJson":       toJSON,
+		"sortedKeys":   sortedKeys,
+		"label":        label,
+	}
+}
+
+// empty is true for nil, zero values and empty strings, slices and maps.
+func empty(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return rv.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return rv.IsNil()
+	case reflect.Bool:
+		return !rv.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return rv.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return rv.Float() == 0
+	}
+	return false
+}
+
+// defaultValue returns v, or def if v is empty. The value comes last so it
+// can be piped: {{ .Labels.TIMEOUT | default "60" }}
+func defaultValue(def interface{}, v ...interface{}) interface{} {
+	if len(v) == 0 || empty(v[0]) {
+		return def
+	}
+	return v[0]
+}
+
+// coalesce returns the first value that is not empty.
+func coalesce(v ...interface{}) interface{} {
+	for _, value := range v {
+		if !empty(value) {
+			return value
+		}
+	}
+	return nil
+}
+
+func regexMatch(regex string, s string) (bool, error) {
+	return regexp.MatchString(regex, s)
+}
+
+func regexReplace(regex string, s string, repl string) (string, error) {
+	re, err := regexp.Compile(regex)
+	if err != nil {
+		return "", err
+	}
+	return re.ReplaceAllString(s, repl), nil
+}
+
+// toStrings turns a slice of any kind into strings.
+func toStrings(v interface{}) ([]string, error) {
+	if s, ok := v.([]string); ok {
+		return s, nil
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, fmt.Errorf("expected a list, got %T", v)
+	}
+	s := make([]string, rv.Len())
+	for i := range s {
+		s[i] = fmt.Sprint(rv.Index(i).Interface())
+	}
+	return s, nil
+}
+
+// sortList returns a sorted copy of a list as strings.
+func sortList(v interface{}) ([]string, error) {
+	s, err := toStrings(v)
+	if err != nil {
+		return nil, err
+	}
+	sorted := make([]string, len(s))
+	copy(sorted, s)
+	sort.Strings(sorted)
+	return sorted, nil
+}
+
+// uniq returns the strings of a list without duplicates, in order.
+func uniq(v interface{}) ([]string, error) {
+	s, err := toStrings(v)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var unique []string
+	for _, e := range s {
+		if !seen[e] {
+			seen[e] = true
+			unique = append(unique, e)
+		}
+	}
+	return unique, nil
+}
+
+// dict builds a map from key and value pairs.
+func dict(v ...interface{}) (map[string]interface{}, error) {
+	if len(v)%2 != 0 {
+		return nil, errors.New("dict needs key and value pairs")
+	}
+	d := make(map[string]interface{}, len(v)/2)
+	for i := 0; i < len(v); i += 2 {
+		d[fmt.Sprint(v[i])] = v[i+1]
+	}
+	return d, nil
+}
+
+func list(v ...interface{}) []interface{} {
+	return v
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func base64Encode(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func base64Decode(s string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	return string(b), err
+}
+
+// toInt converts numbers and numeric strings to an int64.
+func toInt(v interface{}) (int64, error) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rv.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return int64(rv.Float()), nil
+	case reflect.String:
+		return strconv.ParseInt(strings.TrimSpace(rv.String()), 10, 64)
+	}
+	return 0, fmt.Errorf("unable to convert %T to int", v)
+}
+
+// ints converts all arguments of a math function.
+func ints(v []interface{}) ([]int64, error) {
+	if len(v) == 0 {
+		return nil, errors.New("missing arguments")
+	}
+	n := make([]int64, len(v))
+	for i := range v {
+		var err error
+		n[i], err = toInt(v[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+func add(v ...interface{}) (int64, error) {
+	n, err := ints(v)
+	if err != nil {
+		return 0, err
+	}
+	var sum int64
+	for _, i := range n {
+		sum += i
+	}
+	return sum, nil
+}
+
+func sub(a, b interface{}) (int64, error) {
+	n, err := ints([]interface{}{a, b})
+	if err != nil {
+		return 0, err
+	}
+	return n[0] - n[1], nil
+}
+
+func mul(v ...interface{}) (int64, error) {
+	n, err := ints(v)
+	if err != nil {
+		return 0, err
+	}
+	product := int64(1)
+	for _, i := range n {
+		product *= i
+	}
+	return product, nil
+}
+
+func div(a, b interface{}) (int64, error) {
+	n, err := ints([]interface{}{a, b})
+	if err != nil {
+		return 0, err
+	}
+	if n[1] == 0 {
+		return 0, errors.New("division by zero")
+	}
+	return n[0] / n[1], nil
+}
+
+func mod(a, b interface{}) (int64, error) {
+	n, err := ints([]interface{}{a, b})
+	if err != nil {
+		return 0, err
+	}
+	if n[1] == 0 {
+		return 0, errors.New("division by zero")
+	}
+	return n[0] % n[1], nil
+}
+
+func maxInt(v ...interface{}) (int64, error) {
+	n, err := ints(v)
+	if err != nil {
+		return 0, err
+	}
+	m := n[0]
+	for _, i := range n[1:] {
+		if i > m {
+			m = i
+		}
+	}
+	return m, nil
+}
+
+func minInt(v ...interface{}) (int64, error) {
+	n, err := ints(v)
+	if err != nil {
+		return 0, err
+	}
+	m := n[0]
+	for _, i := range n[1:] {
+		if i < m {
+			m = i
+		}
+	}
+	return m, nil
+}
+
+func toJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// sortedKeys returns the keys of a map in order, to range over maps with a
+// stable output.
+func sortedKeys(v interface{}) ([]string, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Map {
+		return nil, fmt.Errorf("expected a map, got %T", v)
+	}
+	keys := make([]string, 0, rv.Len())
+	for _, k := range rv.MapKeys() {
+		keys = append(keys, fmt.Sprint(k.Interface()))
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// label returns a label, or the default if it is not set or empty.
+func label(labels map[string]string, name string, def ...string) string {
+	if v := labels[name]; v != "" {
+		return v
+	}
+	if len(def) > 0 {
+		return def[0]
+	}
+	return ""
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"text/template"
+)
+
+func TestDefaultValue(t *testing.T) {
+	tests := []struct {
+		v    []interface{}
+		want interface{}
+	}{
+		{nil, "def"},
+		{[]interface{}{nil}, "def"},
+		{[]interface{}{""}, "def"},
+		{[]interface{}{0}, "def"},
+		{[]interface{}{false}, "def"},
+		{[]interface{}{[]string{}}, "def"},
+		{[]interface{}{map[string]string{}}, "def"},
+		{[]interface{}{(*App)(nil)}, "def"},
+		{[]interface{}{"value"}, "value"},
+		{[]interface{}{1}, 1},
+		{[]interface{}{true}, true},
+		{[]interface{}{" "}, " "},
+	}
+	for _, test := range tests {
+		got := defaultValue("def", test.v...)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("default %#v = %#v, expected %#v", test.v, got, test.want)
+		}
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	tests := []struct {
+		v    []interface{}
+		want interface{}
+	}{
+		{nil, nil},
+		{[]interface{}{"", nil, 0, []int{}}, nil},
+		{[]interface{}{"", nil, "a", "b"}, "a"},
+		{[]interface{}{0, 2}, 2},
+		{[]interface{}{map[string]string{}, map[string]string{"a": "b"}}, map[string]string{"a": "b"}},
+	}
+	for _, test := range tests {
+		got := coalesce(test.v...)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("coalesce %#v = %#v, expected %#v", test.v, got, test.want)
+		}
+	}
+}
+
+func TestMath(t *testing.T) {
+	tests := []struct {
+		name string
+		fn   func() (int64, error)
+		want int64
+	}{
+		{"add", func() (int64, error) { return add("1", " 2 ", 3) }, 6},
+		{"sub", func() (int64, error) { return sub("5", 2) }, 3},
+		{"mul", func() (int64, error) { return mul("2", int64(3), uint(4)) }, 24},
+		{"div", func() (int64, error) { return div("7", "2") }, 3},
+		{"mod", func() (int64, error) { return mod(7, "3") }, 1},
+		{"max", func() (int64, error) { return maxInt("3", "10", 2) }, 10},
+		{"min", func() (int64, error) { return minInt("3", "10", -2) }, -2},
+		{"int", func() (int64, error) { return toInt("42") }, 42},
+		{"int float", func() (int64, error) { return toInt(2.9) }, 2},
+	}
+	for _, test := range tests {
+		got, err := test.fn()
+		if err != nil {
+			t.Errorf("%s failed: %v", test.name, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s = %d, expected %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMathErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		fn   func() (int64, error)
+	}{
+		{"div by zero", func() (int64, error) { return div(1, 0) }},
+		{"div by zero string", func() (int64, error) { return div("1", "0") }},
+		{"mod by zero", func() (int64, error) { return mod(1, 0) }},
+		{"mod by zero string", func() (int64, error) { return mod("1", " 0") }},
+		{"add not a number", func() (int64, error) { return add(1, "a") }},
+		{"add no arguments", func() (int64, error) { return add() }},
+		{"max no arguments", func() (int64, error) { return maxInt() }},
+		{"int list", func() (int64, error) { return toInt([]int{1}) }},
+	}
+	for _, test := range tests {
+		got, err := test.fn()
+		if err == nil {
+			t.Errorf("%s = %d, expected an error", test.name, got)
+		}
+	}
+}
+
+func TestSortedKeys(t *testing.T) {
+	tests := []struct {
+		v    interface{}
+		want []string
+	}{
+		{map[string]string{"b": "1", "a": "2", "c": "3"}, []string{"a", "b", "c"}},
+		{map[string]App{}, []string{}},
+		{map[int]bool{10: true, 2: true}, []string{"10", "2"}},
+	}
+	for _, test := range tests {
+		got, err := sortedKeys(test.v)
+		if err != nil {
+			t.Errorf("sortedKeys %v failed: %v", test.v, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("sortedKeys %v = %v, expected %v", test.v, got, test.want)
+		}
+	}
+	_, err := sortedKeys([]string{"a"})
+	if err == nil {
+		t.Error("sortedKeys of a list, expected an error")
+	}
+}
+
+func TestTemplateFuncs(t *testing.T) {
+	tests := []struct {
+		tmpl string
+		want string
+	}{
+		{`{{hasSuffix "app.example.com" ".com"}}`, "true"},
+		{`{{hasSuffix "com.example" "com"}}`, "false"},
+		{`{{hasPrefix "com.example" "com"}}`, "true"},
+		{`{{"" | default "60"}}`, "60"},
+		{`{{"30" | default "60"}}`, "30"},
+		{`{{add "1" 2 | mul 3}}`, "9"},
+		{`{{max 1 "5" 3}} {{min 4 "2" 3}}`, "5 2"},
+		{`{{range sortedKeys (dict "b" 1 "a" 2)}}{{.}}{{end}}`, "ab"},
+	}
+	for _, test := range tests {
+		tmpl, err := template.New("test").Funcs(templateFuncs()).Parse(test.tmpl)
+		if err != nil {
+			t.Errorf("%s failed to parse: %v", test.tmpl, err)
+			continue
+		}
+		var buf bytes.Buffer
+		err = tmpl.Execute(&buf, nil)
+		if err != nil {
+			t.Errorf("%s failed: %v", test.tmpl, err)
+			continue
+		}
+		if buf.String() != test.want {
+			t.Errorf("%s = %q, expected %q", test.tmpl, buf.String(), test.want)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+)
+
+// Revision of a rendered nginx config.
+type Revision struct {
+	ID         int
+	Timestamp  time.Time
+	Trigger    string
+	RolledBack bool
+	Files      map[string]string `json:",omitempty"`
+}
+
+// History keeps the last rendered configs.
+type History struct {
+	sync.RWMutex
+	revisions []Revision
+	next      int
+}
+
+var history = History{next: 1}
+
+func (h *History) add(files map[string][]byte, trigger string) {
+	h.Lock()
+	defer h.Unlock()
+	if config.HistorySize <= 0 {
+		return
+	}
+	rev := Revision{
+		ID:        h.next,
+		Timestamp: time.Now(),
+		Trigger:   trigger,
+		Files:     make(map[string]string),
+	}
+	for path, b := range files {
+		rev.Files[path] = string(b)
+	}
+	h.revisions = append(h.revisions, rev)
+	h.next++
+	if len(h.revisions) > config.HistorySize {
+		h.revisions = h.revisions[len(h.revisions)-config.HistorySize:]
+	}
+}
+
+// rolledBack marks the latest revision as refused by nginx.
+func (h *History) rolledBack() {
+	h.Lock()
+	defer h.Unlock()
+	if len(h.revisions) > 0 {
+		h.revisions[len(h.revisions)-1].RolledBack = true
+	}
+}
+
+// get returns a revision and the one before it, if still kept.
+func (h *History) get(id int) (rev, prev *Revision) {
+	h.RLock()
+	defer h.RUnlock()
+	for i := range h.revisions {
+		if h.revisions[i].ID != id {
+			continue
+		}
+		r := h.revisions[i]
+		if i > 0 {
+			p := h.revisions[i-1]
+			return &r, &p
+		}
+		return &r, nil
+	}
+	return nil, nil
+}
+
+func historyID(r *http.Request) int {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	return id
+}
+
+func nixyHistory(w http.ResponseWriter, r *http.Request) {
+	history.RLock()
+	revisions := make([]Revision, 0, len(history.revisions))
+	for i := len(history.revisions) - 1; i >= 0; i-- {
+		rev := history.revisions[i]
+		rev.Files = nil
+		revisions = append(revisions, rev)
+	}
+	history.RUnlock()
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	b, _ := json.MarshalIndent(revisions, "", "  ")
+	w.Write(b)
+	return
+}
+
+func nixyHistoryRevision(w http.ResponseWriter, r *http.Request) {
+	rev, _ := history.get(historyID(r))
+	if rev == nil {
+		http.Error(w, "revision not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	b, _ := json.MarshalIndent(rev, "", "  ")
+	w.Write(b)
+	return
+}
+
+func nixyHistoryDiff(w http.ResponseWriter, r *http.Request) {
+	rev, prev := history.get(historyID(r))
+	if rev == nil {
+		http.Error(w, "revision not found", http.StatusNotFound)
+		return
+	}
+	if prev == nil {
+		http.Error(w, "previous revision not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+	var paths []string
+	for path := range rev.Files {
+		paths = append(paths, path)
+	}
+	for path := range prev.Files {
+		if _, ok := rev.Files[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		fmt.Fprint(w, unifiedDiff(prev.Files[path], rev.Files[path],
+			fmt.Sprintf("%s (revision %d)", path, prev.ID), fmt.Sprintf("%s (revision %d)", path, rev.ID)))
+	}
+	return
+}
+
+func nixyHistoryRestore(w http.ResponseWriter, r *http.Request) {
+	rev, _ := history.get(historyID(r))
+	if rev == nil {
+		http.Error(w, "revision not found", http.StatusNotFound)
+		return
+	}
+	logger.WithFields(logrus.Fields{
+		"client":   r.RemoteAddr,
+		"revision": rev.ID,
+	}).Info("config restore triggered")
+	err := restoreRevision(rev)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, "restored")
+	return
+}
+
+// restoreRevision puts an old config back in place and reloads nginx. It
+// stays until the next change in Marathon renders the template again.
+func restoreRevision(rev *Revision) error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	files := make(map[string][]byte)
+	for path, conf := range rev.Files {
+		files[path] = []byte(conf)
+	}
+	config.RLock()
+	err := installConf(files)
+	config.RUnlock()
+	if err != nil {
+		return err
+	}
+	history.add(files, fmt.Sprintf("restore of revision %d", rev.ID))
+	err = reloadOrRollback()
+	if err != nil {
+		return err
+	}
+	config.LastUpdates.LastNginxReload = time.Now()
+	return nil
+}
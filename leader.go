@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// MarathonLeader struct returned by /v2/leader
+type MarathonLeader struct {
+	Leader string `json:"leader"`
+}
+
+// Leader keeps track of the current Marathon leader.
+type Leader struct {
+	sync.RWMutex
+	endpoint string
+	// user of the endpoint the leader was resolved from, kept out of the
+	// leader url so it is not shown anywhere.
+	user *url.Userinfo
+}
+
+var leader Leader
+
+var errAllEndpointsDown = errors.New("all endpoints are down")
+
+// healthyEndpoint returns the first healthy endpoint in priority order.
+func healthyEndpoint() (string, error) {
+	for _, es := range health.Endpoints {
+		if es.Healthy == true {
+			return es.Endpoint, nil
+		}
+	}
+	return "", errAllEndpointsDown
+}
+
+// marathonEndpoint returns the endpoint to talk to, the current leader if
+// leader discovery is enabled, otherwise the first healthy endpoint.
+func marathonEndpoint() (string, error) {
+	endpoint, err := healthyEndpoint()
+	if err != nil {
+		return "", err
+	}
+	if !config.LeaderDiscovery || behindProxy(endpoint) {
+		return endpoint, nil
+	}
+	leader.RLock()
+	current := leader.endpoint
+	leader.RUnlock()
+	if current != "" {
+		return current, nil
+	}
+	current, err = resolveLeader(endpoint)
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"error":    err.Error(),
+			"endpoint": endpoint,
+		}).Warn("unable to resolve marathon leader")
+		go countLeaderResolveErrors.Inc()
+		return endpoint, nil
+	}
+	u, _ := url.Parse(endpoint)
+	setLeader(current, u.User)
+	return current, nil
+}
+
+// behindProxy is true for endpoints with a path, like Marathon behind the
+// DC/OS admin router. The leader is only reachable through the proxy then.
+func behindProxy(endpoint string) bool {
+	u, err := url.Parse(endpoint)
+	return err != nil || strings.Trim(u.Path, "/") != ""
+}
+
+// resolveLeader asks an endpoint for the current leader, the scheme of the
+// endpoint is reused since Marathon only returns host and port.
+func resolveLeader(endpoint string) (string, error) {
+	client := &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: tr,
+	}
+	req, err := http.NewRequest("GET", endpoint+"/v2/leader", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := marathonDo(client, req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New("unable to resolve leader: " + resp.Status)
+	}
+	l := MarathonLeader{}
+	err = json.NewDecoder(resp.Body).Decode(&l)
+	if err != nil {
+		return "", err
+	}
+	if l.Leader == "" {
+		return "", errors.New("no leader elected")
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	current := url.URL{Scheme: u.Scheme, Host: l.Leader}
+	return current.String(), nil
+}
+
+func setLeader(endpoint string, user *url.Userinfo) {
+	leader.Lock()
+	defer leader.Unlock()
+	leader.user = user
+	if leader.endpoint == endpoint {
+		return
+	}
+	logger.WithFields(logrus.Fields{
+		"leader": endpoint,
+	}).Info("marathon leader resolved")
+	if leader.endpoint != "" {
+		gaugeMarathonLeader.DeleteLabelValues(leader.endpoint)
+	}
+	gaugeMarathonLeader.WithLabelValues(endpoint).Set(1)
+	leader.endpoint = endpoint
+	health.Leader = endpoint
+}
+
+// resetLeader forgets the current leader, it is resolved again on next use.
+func resetLeader() {
+	if !config.LeaderDiscovery {
+		return
+	}
+	leader.Lock()
+	defer leader.Unlock()
+	if leader.endpoint == "" {
+		return
+	}
+	gaugeMarathonLeader.DeleteLabelValues(leader.endpoint)
+	leader.endpoint = ""
+	leader.user = nil
+	health.Leader = ""
+}
+
+// leaderUser returns the user of the endpoint the leader was resolved from,
+// for requests to the leader at host.
+func leaderUser(host string) *url.Userinfo {
+	leader.RLock()
+	defer leader.RUnlock()
+	if leader.endpoint == "" || leader.user == nil {
+		return nil
+	}
+	u, err := url.Parse(leader.endpoint)
+	if err != nil || u.Host != host {
+		return nil
+	}
+	return leader.user
+}
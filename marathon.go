@@ -9,11 +9,11 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"os"
-	"os/exec"
+	"net/url"
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"sort"
 	"strings"
 	"text/template"
 	"time"
@@ -23,44 +23,97 @@ import (
 
 // MarathonApps struct for our apps nested with tasks.
 type MarathonApps struct {
-	Apps []struct {
-		ID              string            `json:"id"`
-		Labels          map[string]string `json:"labels"`
-		Env             map[string]string `json:"env"`
-		PortDefinitions []struct {
-			Port     int64             `json:"port"`
-			Protocol string            `json:"protocol"`
-			Name     string            `json:"name"`
-			Labels   map[string]string `json:"labels"`
-		} `json:"portDefinitions"`
-		Container struct {
-			PortMappings []struct {
-				ContainerPort int64             `json:"containerPort"`
-				HostPort      int64             `json:"hostPort"`
-				Labels        map[string]string `json:"labels"`
-				Protocol      string            `json:"protocol"`
-				ServicePort   int64             `json:"servicePort"`
-			} `json:"portMappings"`
-		} `json:"container"`
-		Tasks []struct {
-			AppID              string `json:"appId"`
-			HealthCheckResults []struct {
-				Alive bool `json:"alive"`
-			} `json:"healthCheckResults"`
-			Host         string  `json:"host"`
-			ID           string  `json:"id"`
-			Ports        []int64 `json:"ports"`
-			ServicePorts []int64 `json:"servicePorts"`
-			SlaveID      string  `json:"slaveId"`
-			StagedAt     string  `json:"stagedAt"`
-			StartedAt    string  `json:"startedAt"`
-			State        string  `json:"state"`
-			Version      string  `json:"version"`
-		} `json:"tasks"`
-		HealthChecks []struct {
-			Path string `json:"path"`
-		} `json:"healthChecks"`
-	} `json:"apps"`
+	Apps []MarathonApp `json:"apps"`
+}
+
+// MarathonSingleApp struct for a single app nested with tasks.
+type MarathonSingleApp struct {
+	App MarathonApp `json:"app"`
+}
+
+// MarathonApp struct
+type MarathonApp struct {
+	ID              string            `json:"id"`
+	Labels          map[string]string `json:"labels"`
+	Env             map[string]string `json:"env"`
+	PortDefinitions []struct {
+		Port     int64             `json:"port"`
+		Protocol string            `json:"protocol"`
+		Name     string            `json:"name"`
+		Labels   map[string]string `json:"labels"`
+	} `json:"portDefinitions"`
+	Container struct {
+		PortMappings []MarathonPortMapping `json:"portMappings"`
+		Docker       struct {
+			Network      string                `json:"network"`
+			PortMappings []MarathonPortMapping `json:"portMappings"`
+		} `json:"docker"`
+	} `json:"container"`
+	Networks  []MarathonNetwork `json:"networks"`
+	IPAddress *struct {
+		NetworkName string `json:"networkName"`
+		Discovery   struct {
+			Ports []struct {
+				Number   int64  `json:"number"`
+				Name     string `json:"name"`
+				Protocol string `json:"protocol"`
+			} `json:"ports"`
+		} `json:"discovery"`
+	} `json:"ipAddress"`
+	Tasks        []MarathonTask        `json:"tasks"`
+	HealthChecks []MarathonHealthCheck `json:"healthChecks"`
+	pod          bool
+}
+
+// MarathonPortMapping struct
+type MarathonPortMapping struct {
+	Name          string            `json:"name"`
+	ContainerPort int64             `json:"containerPort"`
+	HostPort      int64             `json:"hostPort"`
+	Labels        map[string]string `json:"labels"`
+	Protocol      string            `json:"protocol"`
+	ServicePort   int64             `json:"servicePort"`
+}
+
+// MarathonNetwork struct
+type MarathonNetwork struct {
+	Mode string `json:"mode"`
+	Name string `json:"name"`
+}
+
+// MarathonIPAddress struct
+type MarathonIPAddress struct {
+	IPAddress string `json:"ipAddress"`
+	Protocol  string `json:"protocol"`
+}
+
+// MarathonHealthCheck struct
+type MarathonHealthCheck struct {
+	Path string `json:"path"`
+}
+
+// MarathonTask struct
+type MarathonTask struct {
+	AppID              string                      `json:"appId"`
+	HealthCheckResults []MarathonHealthCheckResult `json:"healthCheckResults"`
+	Host               string                      `json:"host"`
+	ID                 string                      `json:"id"`
+	Ports              []int64                     `json:"ports"`
+	ServicePorts       []int64                     `json:"servicePorts"`
+	SlaveID            string                      `json:"slaveId"`
+	StagedAt           string                      `json:"stagedAt"`
+	StartedAt          string                      `json:"startedAt"`
+	State              string                      `json:"state"`
+	Version            string                      `json:"version"`
+	IPAddresses        []MarathonIPAddress         `json:"ipAddresses"`
+	Endpoints          map[string]int64            `json:"-"`
+	ContainerEndpoints map[string]int64            `json:"-"`
+	ContainerPorts     []int64                     `json:"-"`
+}
+
+// MarathonHealthCheckResult struct
+type MarathonHealthCheckResult struct {
+	Alive bool `json:"alive"`
 }
 
 func eventStream() {
@@ -71,19 +124,13 @@ func eventStream() {
 		}
 		ticker := time.NewTicker(1 * time.Second)
 		for range ticker.C {
-			var endpoint string
-			for _, es := range health.Endpoints {
-				if es.Healthy == true {
-					endpoint = es.Endpoint
-					break
-				}
-			}
-			if endpoint == "" {
-				logger.Error("all endpoints are down")
+			endpoint, err := marathonEndpoint()
+			if err != nil {
+				logger.Error(err.Error())
 				go countAllEndpointsDownErrors.Inc()
 				continue
 			}
-			req, err := http.NewRequest("GET", endpoint+"/v2/events", nil)
+			req, err := http.NewRequest("GET", endpoint+"/v2/events"+eventQuery(), nil)
 			if err != nil {
 				logger.WithFields(logrus.Fields{
 					"error":    err.Error(),
@@ -93,9 +140,6 @@ func eventStream() {
 				continue
 			}
 			req.Header.Set("Accept", "text/event-stream")
-			if config.User != "" {
-				req.SetBasicAuth(config.User, config.Pass)
-			}
 			// Using new context package from Go 1.7
 			ctx, cancel := context.WithCancel(context.TODO())
 			// initial request cancellation timer of 15s
@@ -105,18 +149,27 @@ func eventStream() {
 				go countMarathonStreamNoDataWarnings.Inc()
 			})
 			req = req.WithContext(ctx)
-			resp, err := client.Do(req)
+			resp, err := marathonDo(client, req)
 			if err != nil {
 				logger.WithFields(logrus.Fields{
 					"error":    err.Error(),
 					"endpoint": endpoint,
 				}).Error("unable to access Marathon event stream")
 				go countMarathonStreamErrors.Inc()
+				resetLeader()
 				// expire request cancellation timer immediately
 				timer.Reset(100 * time.Millisecond)
 				continue
 			}
+			// events may have been missed while not connected.
+			state.forceResync()
+			select {
+			case eventqueue <- "reconnect":
+			default:
+				logger.Warn("queue is full")
+			}
 			reader := bufio.NewReader(resp.Body)
+			var event, data string
 			for {
 				// reset request cancellation timer to 15s (should be >10s to avoid unnecessary reconnects
 				// since ~10s seems to be the rate for dummy/keepalive events on the marathon event stream
@@ -128,22 +181,38 @@ func eventStream() {
 						"endpoint": endpoint,
 					}).Error("error reading Marathon event stream")
 					go countMarathonStreamErrors.Inc()
+					resetLeader()
 					resp.Body.Close()
 					break
 				}
-				if !strings.HasPrefix(line, "event: ") {
+				line = strings.TrimRight(line, "\r\n")
+				switch {
+				case strings.HasPrefix(line, "event: "):
+					event = strings.TrimSpace(line[6:])
+					continue
+				case strings.HasPrefix(line, "data: "):
+					data += line[6:]
+					continue
+				case line != "" || event == "":
+					continue
+				}
+				// an empty line ends the event.
+				if !eventWanted(event) {
+					logger.WithFields(logrus.Fields{
+						"event":    event,
+						"endpoint": endpoint,
+					}).Debug("marathon event ignored")
+					go countMarathonEventsIgnored.WithLabelValues(event).Inc()
+					event, data = "", ""
 					continue
 				}
 				logger.WithFields(logrus.Fields{
-					"event":    strings.TrimSpace(line[6:]),
+					"event":    event,
 					"endpoint": endpoint,
 				}).Info("marathon event received")
-				go countMarathonEventsReceived.Inc()
-				select {
-				case eventqueue <- true: // add reload to our queue channel, unless it is full of course.
-				default:
-					logger.Warn("queue is full")
-				}
+				go countMarathonEventsReceived.WithLabelValues(event).Inc()
+				handleEvent(event, data)
+				event, data = "", ""
 			}
 			resp.Body.Close()
 			logger.Warn("event stream connection was closed, re-opening")
@@ -172,10 +241,7 @@ func endpointHealth() {
 						health.Endpoints[i].Message = err.Error()
 						continue
 					}
-					if config.User != "" {
-						req.SetBasicAuth(config.User, config.Pass)
-					}
-					resp, err := client.Do(req)
+					resp, err := marathonDo(client, req)
 					if err != nil {
 						logger.WithFields(logrus.Fields{
 							"error":    err.Error(),
@@ -205,30 +271,132 @@ func endpointHealth() {
 	}()
 }
 
+// eventWanted checks an event type against the configured allow and deny lists.
+func eventWanted(event string) bool {
+	for _, t := range config.IgnoreEventTypes {
+		if t == event {
+			return false
+		}
+	}
+	if len(config.EventTypes) == 0 {
+		return true
+	}
+	for _, t := range config.EventTypes {
+		if t == event {
+			return true
+		}
+	}
+	return false
+}
+
+// eventQuery subscribes to the allowed event types only. Marathon versions
+// without support for event_type ignore it, events are filtered here anyway.
+func eventQuery() string {
+	if len(config.EventTypes) == 0 {
+		return ""
+	}
+	q := url.Values{}
+	for _, t := range config.EventTypes {
+		q.Add("event_type", t)
+	}
+	return "?" + q.Encode()
+}
+
+// handleEvent applies the event payload to the known state and queues a reload.
+func handleEvent(event, data string) {
+	if event == "leader_changed" {
+		resetLeader()
+	}
+	ev := MarathonEvent{}
+	err := json.Unmarshal([]byte(data), &ev)
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"event": event,
+			"error": err.Error(),
+		}).Warn("unable to parse marathon event, forcing resync")
+		state.forceResync()
+	} else {
+		ev.EventType = event
+		state.applyEvent(ev)
+	}
+	select {
+	case eventqueue <- event: // add reload to our queue channel, unless it is full of course.
+	default:
+		logger.Warn("queue is full")
+	}
+}
+
 func eventWorker() {
+	if config.ResyncInterval.Duration > 0 {
+		go func() {
+			// fetch all apps now and then, in case an event was missed.
+			ticker := time.NewTicker(config.ResyncInterval.Duration)
+			for range ticker.C {
+				state.forceResync()
+				select {
+				case eventqueue <- "resync":
+				default:
+				}
+			}
+		}()
+	}
 	go func() {
-		// a ticker channel to limit reloads to marathon, 1s is enough for now.
-		ticker := time.NewTicker(1 * time.Second)
+		var lastReload time.Time
 		for {
-			select {
-			case <-ticker.C:
-				<-eventqueue
-				reload()
+			triggers := map[string]int{<-eventqueue: 1}
+			coalesced := 1
+			first := time.Now()
+			deadline := first.Add(config.ReloadDebounce.Duration)
+			maxDeadline := first.Add(config.ReloadMaxDelay.Duration)
+		wait:
+			for {
+				// wait for the events to calm down, but not longer than the max delay,
+				// and never reload more often than the min reload interval.
+				fire := deadline
+				if maxDeadline.Before(fire) {
+					fire = maxDeadline
+				}
+				if next := lastReload.Add(config.MinReloadInterval.Duration); next.After(fire) {
+					fire = next
+				}
+				timer := time.NewTimer(time.Until(fire))
+				select {
+				case trigger := <-eventqueue:
+					timer.Stop()
+					triggers[trigger]++
+					coalesced++
+					deadline = time.Now().Add(config.ReloadDebounce.Duration)
+				case <-timer.C:
+					break wait
+				}
 			}
+			logger.WithFields(logrus.Fields{
+				"events": coalesced,
+				"waited": time.Since(first),
+			}).Debug("reloading after events")
+			go observeCoalescedEventsMetric(coalesced)
+			reload(describeTriggers(triggers))
+			lastReload = time.Now()
 		}
 	}()
 }
 
-func fetchApps(jsonapps *MarathonApps) error {
-	var endpoint string
-	for _, es := range health.Endpoints {
-		if es.Healthy == true {
-			endpoint = es.Endpoint
-			break
+// describeTriggers summarizes what caused a reload, like "manual, status_update_event (3)".
+func describeTriggers(triggers map[string]int) string {
+	var parts []string
+	for trigger, n := range triggers {
+		if n > 1 {
+			trigger = fmt.Sprintf("%s (%d)", trigger, n)
 		}
+		parts = append(parts, trigger)
 	}
-	if endpoint == "" {
-		err := errors.New("all endpoints are down")
+	sort.Strings(parts)
+	return strings.Join(parts, ", ")
+}
+
+func fetchApps(jsonapps *MarathonApps) error {
+	endpoint, err := marathonEndpoint()
+	if err != nil {
 		return err
 	}
 	client := &http.Client{
@@ -241,10 +409,7 @@ func fetchApps(jsonapps *MarathonApps) error {
 		return err
 	}
 	req.Header.Set("Accept", "application/json")
-	if config.User != "" {
-		req.SetBasicAuth(config.User, config.Pass)
-	}
-	resp, err := client.Do(req)
+	resp, err := marathonDo(client, req)
 	if err != nil {
 		return err
 	}
@@ -257,31 +422,90 @@ func fetchApps(jsonapps *MarathonApps) error {
 	return nil
 }
 
-func syncApps(jsonapps *MarathonApps) bool {
+// fetchJSON decodes the response of a GET request to Marathon into v,
+// found is false if Marathon responded with 404.
+func fetchJSON(path string, v interface{}) (found bool, err error) {
+	endpoint, err := marathonEndpoint()
+	if err != nil {
+		return false, err
+	}
+	client := &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: tr,
+	}
+	req, err := http.NewRequest("GET", endpoint+path, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := marathonDo(client, req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, errors.New("unable to fetch " + path + ": " + resp.Status)
+	}
+	decoder := json.NewDecoder(resp.Body)
+	err = decoder.Decode(v)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// escapeID turns an app id into a path relative to /v2/apps or /v2/pods.
+func escapeID(id string) string {
+	return strings.TrimPrefix((&url.URL{Path: id}).EscapedPath(), "/")
+}
+
+// syncApps updates the apps from Marathon, it returns if they are equal to
+// the known apps and if only their tasks changed.
+func syncApps(jsonapps *MarathonApps) (equal bool, tasksOnly bool) {
 	config.Lock()
 	defer config.Unlock()
 	apps := make(map[string]App)
+	excluded := make(map[string][]Exclusion)
+	realmScoped := realmOutputs()
 	for _, app := range jsonapps.Apps {
 		var newapp = App{}
 		if config.Realm != "" && app.Labels["NIXY_REALM"] != config.Realm {
+			excluded[app.ID] = []Exclusion{{Reason: reasonRealm, Detail: app.Labels["NIXY_REALM"]}}
 			continue
 		}
+		excluded[app.ID] = nil
+		exclude := func(task MarathonTask, reason string) {
+			excluded[app.ID] = append(excluded[app.ID], Exclusion{Task: task.ID, State: task.State, Reason: reason})
+		}
+		excludeApp := func(reason string, detail string) {
+			excluded[app.ID] = append(excluded[app.ID], Exclusion{Reason: reason, Detail: detail})
+		}
+		network := networkMode(app)
+		portNameMissing := false
 		for _, task := range app.Tasks {
+			address, ports := taskAddress(app, task, network)
 			// lets skip tasks that does not expose any ports.
-			if len(task.Ports) == 0 {
+			if len(ports) == 0 {
+				exclude(task, reasonNoPorts)
 				continue
 			}
-			// also skip of there is no host set.
-			if task.Host == "" {
+			// also skip of there is no host or ip set.
+			if address == "" {
+				exclude(task, reasonNoAddress)
 				continue
 			}
 			// ignore tasks that are not explicitly running (staging, starting, killing, unreachable, etc)
 			if task.State != "TASK_RUNNING" {
+				exclude(task, reasonNotRunning)
 				continue
 			}
 			if len(app.HealthChecks) > 0 {
 				if len(task.HealthCheckResults) == 0 {
 					// this means tasks is being deployed but not yet monitored as alive. Assume down.
+					exclude(task, reasonHealthUnknown)
 					continue
 				}
 				alive := true
@@ -293,6 +517,7 @@ func syncApps(jsonapps *MarathonApps) bool {
 				}
 				if alive != true {
 					// at least one health check has failed. Assume down.
+					exclude(task, reasonUnhealthy)
 					continue
 				}
 			}
@@ -307,8 +532,26 @@ func syncApps(jsonapps *MarathonApps) bool {
 			newtask.StartedAt = task.StartedAt
 			newtask.State = task.State
 			newtask.Version = task.Version
+			newtask.Endpoints = task.Endpoints
+			newtask.IPAddresses = ipAddresses(task)
+			newtask.ContainerPorts = containerPorts(app, task)
+			newtask.Network = network
+			newtask.Address = address
+			newtask.TargetPorts = ports
+			var found bool
+			newtask.NamedPorts, newtask.Port, found = namedPorts(app, task, network, ports)
+			if !found {
+				portNameMissing = true
+			}
 			newapp.Tasks = append(newapp.Tasks, newtask)
 		}
+		if portNameMissing {
+			logger.WithFields(logrus.Fields{
+				"app":  app.ID,
+				"port": app.Labels["NIXY_PORT_NAME"],
+			}).Warn("port name not found, using first port")
+			go countPortNameNotFoundWarnings.Inc()
+		}
 		// Lets ignore apps if no tasks are available
 		if len(newapp.Tasks) > 0 {
 			if s, ok := app.Labels["subdomain"]; ok {
@@ -323,6 +566,7 @@ func syncApps(jsonapps *MarathonApps) bool {
 							"subdomain": host,
 						}).Warn("invalid subdomain label")
 						go countInvalidSubdomainLabelWarnings.Inc()
+						excludeApp(reasonInvalidSubdomain, host)
 					}
 				}
 				// to be compatible with moxy, will probably be removed eventually.
@@ -338,6 +582,7 @@ func syncApps(jsonapps *MarathonApps) bool {
 							"subdomain": host,
 						}).Warn("invalid subdomain label")
 						go countInvalidSubdomainLabelWarnings.Inc()
+						excludeApp(reasonInvalidSubdomain, host)
 					}
 				}
 			} else {
@@ -353,6 +598,10 @@ func syncApps(jsonapps *MarathonApps) bool {
 			}
 			// Check for duplicated subdomain labels
 			for _, confapp := range apps {
+				// outputs for different realms may share subdomains.
+				if realmScoped && confapp.Labels["NIXY_REALM"] != app.Labels["NIXY_REALM"] {
+					continue
+				}
 				for _, host := range confapp.Hosts {
 					for _, newhost := range newapp.Hosts {
 						if newhost == host {
@@ -361,6 +610,7 @@ func syncApps(jsonapps *MarathonApps) bool {
 								"subdomain": host,
 							}).Warn("duplicate subdomain label")
 							go countDuplicateSubdomainLabelWarnings.Inc()
+							excludeApp(reasonDuplicateSubdomain, host)
 							// reset hosts if duplicate.
 							newapp.Hosts = nil
 						}
@@ -373,6 +623,9 @@ func syncApps(jsonapps *MarathonApps) bool {
 			}
 			newapp.Labels = app.Labels
 			newapp.Env = app.Env
+			newapp.Pod = app.pod
+			newapp.ServerSnippet = appSnippet(app, labelServerSnippet, "server")
+			newapp.LocationSnippet = appSnippet(app, labelLocationSnippet, "location")
 			for _, healthcheck := range app.HealthChecks {
 				hc := HealthCheck{
 					Path: healthcheck.Path,
@@ -389,8 +642,9 @@ func syncApps(jsonapps *MarathonApps) bool {
 				newapp.PortDefinitions = append(newapp.PortDefinitions, pd)
 			}
 
-			for _, pms := range app.Container.PortMappings {
+			for _, pms := range app.portMappings() {
 				pm := PortMappings{
+					Name:          pms.Name,
 					ContainerPort: pms.ContainerPort,
 					HostPort:      pms.HostPort,
 					Labels:        pms.Labels,
@@ -401,74 +655,121 @@ func syncApps(jsonapps *MarathonApps) bool {
 			}
 
 			apps[app.ID] = newapp
+		} else {
+			excludeApp(reasonNoTasks, "")
 		}
 	}
+	exclusions.set(excluded)
 	// Not all events bring changes, so lets see if anything is new.
 	eq := reflect.DeepEqual(apps, config.Apps)
 	if eq {
-		return true
+		return true, false
 	}
+	tasksOnly = onlyTasksChanged(config.Apps, apps)
 	config.Apps = apps
-	return false
+	return false, tasksOnly
 }
 
-func writeConf() error {
+// renderConf renders the template of every output, keyed by output path.
+func renderConf() (map[string][]byte, error) {
 	config.RLock()
 	defer config.RUnlock()
-	template, err := getTmpl()
-	if err != nil {
-		return err
+	files := make(map[string][]byte)
+	for _, o := range outputs() {
+		template, err := getTmpl(o)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		err = template.Execute(&buf, config.forOutput(o))
+		if err != nil {
+			return nil, err
+		}
+		files[o.Config] = buf.Bytes()
 	}
+	return files, nil
+}
 
-	parent := filepath.Dir(config.NginxConfig)
-	tmpFile, err := ioutil.TempFile(parent, ".nginx.conf.tmp-")
-	defer tmpFile.Close()
-	lastConfig = tmpFile.Name()
-	err = template.Execute(tmpFile, &config)
+func writeConf(trigger string) error {
+	files, err := renderConf()
 	if err != nil {
 		return err
 	}
+	config.RLock()
+	defer config.RUnlock()
 	config.LastUpdates.LastConfigRendered = time.Now()
-	err = checkConf(tmpFile.Name())
+	err = installConf(files)
 	if err != nil {
 		return err
 	}
-	err = os.Rename(tmpFile.Name(), config.NginxConfig)
-	if err != nil {
-		return err
-	}
-	lastConfig = config.NginxConfig
+	history.add(files, trigger)
 	return nil
 }
 
 func checkTmpl() error {
 	config.RLock()
 	defer config.RUnlock()
-	t, err := getTmpl()
-	if err != nil {
-		return err
+	for _, o := range outputs() {
+		t, err := getTmpl(o)
+		if err != nil {
+			return err
+		}
+		err = t.Execute(ioutil.Discard, config.forOutput(o))
+		if err != nil {
+			return err
+		}
 	}
-	err = t.Execute(ioutil.Discard, &config)
+	return nil
+}
+
+func getTmpl(o Output) (*template.Template, error) {
+	return parseTmpl(o, templateFuncs())
+}
+
+// parseTmpl parses the template of an output and its partials with the
+// given functions.
+func parseTmpl(o Output, funcs template.FuncMap) (*template.Template, error) {
+	t, err := template.New(filepath.Base(o.Template)).
+		Delims(o.LeftDelimiter, o.RightDelimiter).
+		Funcs(funcs).
+		ParseFiles(o.Template)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	partials, err := templatePartials(o)
+	if err != nil || len(partials) == 0 {
+		return t, err
+	}
+	// partials are parsed after the template, so their defines replace its blocks.
+	return t.ParseFiles(partials...)
 }
 
-func getTmpl() (*template.Template, error) {
-	return template.New(filepath.Base(config.NginxTemplate)).
-		Delims(config.LeftDelimiter, config.RightDelimiter).
-		Funcs(template.FuncMap{
-			"hasPrefix": strings.HasPrefix,
-			"hasSuffix": strings.HasPrefix,
-			"contains":  strings.Contains,
-			"split":     strings.Split,
-			"join":      strings.Join,
-			"trim":      strings.Trim,
-			"replace":   strings.Replace,
-			"getenv":    os.Getenv,
-			"datetime":  time.Now}).
-		ParseFiles(config.NginxTemplate)
+// templatePartials returns the files matching template_dir, except the
+// template of the output itself. Templates are named by file name, so a
+// partial with the same name as another or as the template would silently
+// replace it and is refused.
+func templatePartials(o Output) ([]string, error) {
+	if config.TemplateDir == "" {
+		return nil, nil
+	}
+	matches, err := filepath.Glob(config.TemplateDir)
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]string{filepath.Base(o.Template): o.Template}
+	var partials []string
+	for _, m := range matches {
+		if filepath.Clean(m) == filepath.Clean(o.Template) {
+			continue
+		}
+		name := filepath.Base(m)
+		if other, ok := names[name]; ok {
+			return nil, fmt.Errorf("partial %s has the same name as %s", m, other)
+		}
+		names[name] = m
+		partials = append(partials, m)
+	}
+	return partials, nil
 }
 
 func checkConf(path string) error {
@@ -476,64 +777,57 @@ func checkConf(path string) error {
 	if config.NginxIgnoreCheck {
 		return nil
 	}
-	// This is to allow arguments as well. Example "docker exec nginx..."
-	args := strings.Fields(config.NginxCmd)
-	head := args[0]
-	args = args[1:]
-	args = append(args, "-c")
-	args = append(args, path)
-	args = append(args, "-t")
-	cmd := exec.Command(head, args...)
-	//cmd := exec.Command(parts..., "-c", path, "-t")
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
-	err := cmd.Run() // will wait for command to return
-	if err != nil {
-		msg := fmt.Sprint(err) + ": " + stderr.String()
-		errstd := errors.New(msg)
-		return errstd
-	}
-	return nil
+	return proxy.Check(path)
 }
 
-func reloadNginx() error {
-	// This is to allow arguments as well. Example "docker exec nginx..."
-	args := strings.Fields(config.NginxCmd)
-	head := args[0]
-	args = args[1:]
-	args = append(args, "-s")
-	args = append(args, "reload")
-	cmd := exec.Command(head, args...)
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
-	err := cmd.Run() // will wait for command to return
-	if err != nil {
-		msg := fmt.Sprint(err) + ": " + stderr.String()
-		errstd := errors.New(msg)
-		return errstd
-	}
-	return nil
+func reloadProxy() error {
+	return proxy.Reload()
 }
 
-func reload() {
+func reload(trigger string) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
 	start := time.Now()
-	jsonapps := MarathonApps{}
-	err := fetchApps(&jsonapps)
+	jsonapps, err := refreshApps()
 	if err != nil {
 		logger.WithFields(logrus.Fields{
 			"error": err.Error(),
 		}).Error("unable to sync from marathon")
 		go statsCount("reload.failed", 1)
 		go countFailedReloads.Inc()
+		renderSnapshot(trigger)
 		return
 	}
-	equal := syncApps(&jsonapps)
-	if equal {
-		logger.Info("no config changes")
-		return
+	snapshotSynced()
+	equal, tasksOnly := syncApps(jsonapps)
+	templateChanged := templates.take()
+	if equal && !renderPending {
+		if !templateChanged {
+			logger.Info("no config changes")
+			return
+		}
+		if !confChanged() {
+			logger.Info("template changed, config unchanged")
+			return
+		}
 	}
+	// only upstream servers changed, and nginx runs the last rendered config
+	// of the same templates.
+	dynamic := upstreams != nil && tasksOnly && !renderPending && !templateChanged
+	// until nginx runs the new apps, later syncs have to render again.
+	renderPending = true
 	config.LastUpdates.LastSync = time.Now()
-	err = writeConf()
+	endpoint, _ := marathonEndpoint()
+	config.RLock()
+	err = writeSnapshot(endpoint)
+	config.RUnlock()
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("unable to write state snapshot")
+		go countSnapshotErrors.Inc()
+	}
+	err = writeConf(trigger)
 	if err != nil {
 		logger.WithFields(logrus.Fields{
 			"error": err.Error(),
@@ -543,7 +837,24 @@ func reload() {
 		return
 	}
 	config.LastUpdates.LastConfigValid = time.Now()
-	err = reloadNginx()
+	if dynamic {
+		err = pushUpstreams()
+		if err == nil {
+			renderPending = false
+			logger.WithFields(logrus.Fields{
+				"took": time.Since(start),
+			}).Info("upstreams updated without reload")
+			go statsCount("upstreams.updated", 1)
+			go countUpstreamUpdates.Inc()
+			return
+		}
+		logger.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Warn("unable to update upstreams, reloading nginx")
+		go statsCount("upstreams.failed", 1)
+		go countUpstreamUpdateErrors.Inc()
+	}
+	err = reloadOrRollback()
 	if err != nil {
 		logger.WithFields(logrus.Fields{
 			"error": err.Error(),
@@ -552,6 +863,19 @@ func reload() {
 		go countFailedReloads.Inc()
 		return
 	}
+	renderPending = false
+	if upstreams != nil {
+		// pushed servers may survive reloads, keep them in line with the
+		// config or render and reload again on the next sync.
+		err = pushUpstreams()
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Warn("unable to update upstreams after reload")
+			go countUpstreamUpdateErrors.Inc()
+			renderPending = true
+		}
+	}
 	elapsed := time.Since(start)
 	logger.WithFields(logrus.Fields{
 		"took": elapsed,
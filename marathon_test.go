@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestTemplatePartials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nixy-partials-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"nginx.tmpl", "location.tmpl", "other/nginx.tmpl"} {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		ioutil.WriteFile(path, []byte("{{/* partial */}}"), 0644)
+	}
+	defer func(old string) { config.TemplateDir = old }(config.TemplateDir)
+
+	// the template itself is skipped when it is in template_dir.
+	config.TemplateDir = filepath.Join(dir, "*.tmpl")
+	partials, err := templatePartials(Output{Template: filepath.Join(dir, "nginx.tmpl")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{filepath.Join(dir, "location.tmpl")}; !reflect.DeepEqual(partials, want) {
+		t.Errorf("partials %v, expected %v", partials, want)
+	}
+
+	// a partial named like the template would replace it.
+	_, err = templatePartials(Output{Template: filepath.Join(dir, "other", "nginx.tmpl")})
+	if err == nil {
+		t.Error("partial with the name of the template accepted")
+	}
+
+	// partials named like each other would replace each other.
+	config.TemplateDir = filepath.Join(dir, "*", "nginx.tmpl")
+	os.MkdirAll(filepath.Join(dir, "more"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "more", "nginx.tmpl"), nil, 0644)
+	_, err = templatePartials(Output{Template: "/etc/nixy/main.tmpl"})
+	if err == nil {
+		t.Error("partials with the same name accepted")
+	}
+}
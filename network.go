@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+)
+
+// Network modes used to decide how tasks are addressed.
+const (
+	networkHost      = "host"
+	networkContainer = "container"
+)
+
+// networkMode decides if the tasks of an app are reached through the agent
+// host and host ports, or through their own ip and container ports. The
+// NIXY_NETWORK label overrides what is detected from the app definition.
+func networkMode(app MarathonApp) string {
+	switch strings.ToLower(app.Labels["NIXY_NETWORK"]) {
+	case networkHost:
+		return networkHost
+	case networkContainer:
+		return networkContainer
+	}
+	for _, n := range app.Networks {
+		// container/bridge still maps ports on the host.
+		if n.Mode == "container" {
+			return networkContainer
+		}
+	}
+	// ip-per-task and docker user networks before Marathon 1.5.
+	if app.IPAddress != nil || app.Container.Docker.Network == "USER" {
+		return networkContainer
+	}
+	return networkHost
+}
+
+// taskAddress returns the address and ports used to reach a task.
+func taskAddress(app MarathonApp, task MarathonTask, network string) (string, []int64) {
+	if network != networkContainer {
+		return task.Host, task.Ports
+	}
+	ips := ipAddresses(task)
+	if len(ips) == 0 {
+		return "", nil
+	}
+	return ips[0], containerPorts(app, task)
+}
+
+// ipAddresses returns the task ips, IPv4 addresses first.
+func ipAddresses(task MarathonTask) []string {
+	var v4, v6 []string
+	for _, ip := range task.IPAddresses {
+		if ip.Protocol == "IPv6" {
+			v6 = append(v6, ip.IPAddress)
+		} else {
+			v4 = append(v4, ip.IPAddress)
+		}
+	}
+	return append(v4, v6...)
+}
+
+// containerPorts returns the ports tasks listen on inside their container.
+func containerPorts(app MarathonApp, task MarathonTask) []int64 {
+	if len(task.ContainerPorts) > 0 {
+		return task.ContainerPorts
+	}
+	var ports []int64
+	for _, pm := range app.portMappings() {
+		ports = append(ports, pm.ContainerPort)
+	}
+	if len(ports) == 0 && app.IPAddress != nil {
+		for _, p := range app.IPAddress.Discovery.Ports {
+			ports = append(ports, p.Number)
+		}
+	}
+	return ports
+}
+
+// portMappings returns the container port mappings, docker containers keep
+// them in container.docker before Marathon 1.5.
+func (app MarathonApp) portMappings() []MarathonPortMapping {
+	if len(app.Container.PortMappings) > 0 {
+		return app.Container.PortMappings
+	}
+	return app.Container.Docker.PortMappings
+}
@@ -8,6 +8,8 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -20,17 +22,25 @@ import (
 
 // Task struct
 type Task struct {
-	AppID        string
-	Host         string
-	ID           string
-	Ports        []int64
-	ServicePorts []int64
-	SlaveID      string
-	StagedAt     string
-	StartedAt    string
-	State        string
-	Version      string
-	Labels       map[string]string
+	AppID          string
+	Host           string
+	ID             string
+	Ports          []int64
+	ServicePorts   []int64
+	SlaveID        string
+	StagedAt       string
+	StartedAt      string
+	State          string
+	Version        string
+	Labels         map[string]string
+	Endpoints      map[string]int64
+	IPAddresses    []string
+	ContainerPorts []int64
+	Network        string
+	Address        string
+	TargetPorts    []int64
+	NamedPorts     map[string]int64
+	Port           int64
 }
 
 // PortDefinitions struct
@@ -43,6 +53,7 @@ type PortDefinitions struct {
 
 // PortMappings struct
 type PortMappings struct {
+	Name          string
 	ContainerPort int64
 	HostPort      int64
 	Labels        map[string]string
@@ -69,26 +80,50 @@ type App struct {
 	PortDefinitions []PortDefinitions
 	HealthChecks    []HealthCheck
 	Container       Container
+	Pod             bool
+	ServerSnippet   string
+	LocationSnippet string
 }
 
 // Config struct used by the template engine
 type Config struct {
 	sync.RWMutex
-	Xproxy           string
-	Realm            string
-	Port             string   `json:"-"`
-	Marathon         []string `json:"-"`
-	User             string   `json:"-"`
-	Pass             string   `json:"-"`
-	NginxConfig      string   `json:"-" toml:"nginx_config"`
-	NginxTemplate    string   `json:"-" toml:"nginx_template"`
-	NginxCmd         string   `json:"-" toml:"nginx_cmd"`
-	NginxIgnoreCheck bool     `json:"-" toml:"nginx_ignore_check"`
-	LeftDelimiter    string   `json:"-" toml:"left_delimiter"`
-	RightDelimiter   string   `json:"-" toml:"right_delimiter"`
-	Statsd           StatsdConfig
-	LastUpdates      Updates
-	Apps             map[string]App
+	Xproxy                string
+	Realm                 string
+	Port                  string          `json:"-"`
+	Marathon              []string        `json:"-"`
+	User                  string          `json:"-"`
+	Pass                  string          `json:"-"`
+	NginxConfig           string          `json:"-" toml:"nginx_config"`
+	NginxTemplate         string          `json:"-" toml:"nginx_template"`
+	TemplateDir           string          `json:"-" toml:"template_dir"`
+	NginxCmd              string          `json:"-" toml:"nginx_cmd"`
+	NginxIgnoreCheck      bool            `json:"-" toml:"nginx_ignore_check"`
+	NginxReload           string          `json:"-" toml:"nginx_reload"`
+	NginxPidFile          string          `json:"-" toml:"nginx_pid_file"`
+	LeftDelimiter         string          `json:"-" toml:"left_delimiter"`
+	RightDelimiter        string          `json:"-" toml:"right_delimiter"`
+	ResyncInterval        Duration        `json:"-" toml:"resync_interval"`
+	MinReloadInterval     Duration        `json:"-" toml:"min_reload_interval"`
+	ReloadDebounce        Duration        `json:"-" toml:"reload_debounce"`
+	ReloadMaxDelay        Duration        `json:"-" toml:"reload_max_delay"`
+	LeaderDiscovery       bool            `json:"-" toml:"leader_discovery"`
+	EventTypes            []string        `json:"-" toml:"event_types"`
+	IgnoreEventTypes      []string        `json:"-" toml:"ignore_event_types"`
+	DCOS                  DCOSConfig      `json:"-"`
+	TLS                   TLSConfig       `json:"-" toml:"marathon_tls"`
+	StateFile             string          `json:"-" toml:"state_file"`
+	HistorySize           int             `json:"-" toml:"history_size"`
+	SnippetDirectives     []string        `json:"-" toml:"snippet_directives"`
+	TemplateWatchInterval Duration        `json:"-" toml:"template_watch_interval"`
+	Outputs               []Output        `json:"-" toml:"output"`
+	Proxy                 string          `json:"-"`
+	HAProxy               HAProxyConfig   `json:"-" toml:"haproxy"`
+	DynamicUpstreams      UpstreamsConfig `json:"-" toml:"dynamic_upstreams"`
+	API                   APIConfig       `json:"-" toml:"api"`
+	Statsd                StatsdConfig
+	LastUpdates           Updates
+	Apps                  map[string]App
 }
 
 // Updates timings used for metrics
@@ -99,6 +134,18 @@ type Updates struct {
 	LastNginxReload    time.Time
 }
 
+// Duration wraps time.Duration so it can be set as a string in the config.
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalText parses durations like "300ms" or "5m".
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
 // StatsdConfig statsd stuct
 type StatsdConfig struct {
 	Addr       string
@@ -121,8 +168,11 @@ type EndpointStatus struct {
 
 // Health struct
 type Health struct {
+	Leader    string          `json:",omitempty"`
+	Snapshot  *SnapshotStatus `json:",omitempty"`
 	Config    Status
 	Template  Status
+	Reload    Status
 	Endpoints []EndpointStatus
 }
 
@@ -130,22 +180,66 @@ type Health struct {
 var version = "master" //set by ldflags
 var date string        //set by ldflags
 var commit string      //set by ldflags
-var config = Config{LeftDelimiter: "{{", RightDelimiter: "}}"}
+var config = Config{
+	LeftDelimiter:         "{{",
+	RightDelimiter:        "}}",
+	ResyncInterval:        Duration{5 * time.Minute},
+	MinReloadInterval:     Duration{1 * time.Second},
+	ReloadMaxDelay:        Duration{10 * time.Second},
+	HistorySize:           10,
+	TemplateWatchInterval: Duration{2 * time.Second},
+	SnippetDirectives: []string{
+		"add_header",
+		"client_body_buffer_size",
+		"client_max_body_size",
+		"gzip",
+		"proxy_buffering",
+		"proxy_connect_timeout",
+		"proxy_read_timeout",
+		"proxy_request_buffering",
+		"proxy_send_timeout",
+		"proxy_set_header",
+	},
+	IgnoreEventTypes: []string{
+		"event_stream_attached",
+		"event_stream_detached",
+		"subscribe_event",
+		"unsubscribe_event",
+		"framework_message_event",
+		"add_health_check_event",
+		"remove_health_check_event",
+		"failed_health_check_event",
+		"api_post_event",
+		"group_change_success",
+		"group_change_failed",
+	},
+}
 var statsd g2s.Statter
 var health Health
 var lastConfig string
+var renderPending bool
 var logger = logrus.New()
 
-// Eventqueue with buffer of two, because we dont really need more.
-var eventqueue = make(chan bool, 2)
+// reloadLock serializes rendering, installing configs and reloading nginx.
+var reloadLock sync.Mutex
+
+// Eventqueue of reload triggers, coalesced by the event worker.
+var eventqueue = make(chan string, 100)
 
 // Global http transport for connection reuse
-var tr = &http.Transport{MaxIdleConnsPerHost: 10}
+var tr = &reloadingTransport{current: &http.Transport{MaxIdleConnsPerHost: 10}}
 
 func (c *Config) MergeAppsByLabel(label string) map[string]App {
 	apps := make(map[string]App, 0)
 	labeledApps := make(map[string][]App, 0)
-	for appID, app := range c.Apps {
+	// merge in order of app id, so the fields taken from the first app are stable.
+	ids := make([]string, 0, len(c.Apps))
+	for appID := range c.Apps {
+		ids = append(ids, appID)
+	}
+	sort.Strings(ids)
+	for _, appID := range ids {
+		app := c.Apps[appID]
 		if labelValue, has := app.Labels[label]; has {
 			labeledApps[labelValue] = append(labeledApps[labelValue], app)
 		} else {
@@ -196,11 +290,16 @@ func mergeApps(apps []App) App {
 		PortDefinitions: portDefs,
 		HealthChecks:    apps[0].HealthChecks,
 		Container:       Container{},
+		Pod:             apps[0].Pod,
+		ServerSnippet:   apps[0].ServerSnippet,
+		LocationSnippet: apps[0].LocationSnippet,
 	}
 }
 
 func newHealth() Health {
 	var h Health
+	h.Reload.Healthy = true
+	h.Reload.Message = "OK"
 	for _, ep := range config.Marathon {
 		var s EndpointStatus
 		s.Endpoint = ep
@@ -215,8 +314,9 @@ func nixyReload(w http.ResponseWriter, r *http.Request) {
 	logger.WithFields(logrus.Fields{
 		"client": r.RemoteAddr,
 	}).Info("marathon reload triggered")
+	state.forceResync()
 	select {
-	case eventqueue <- true: // Add reload to our queue channel, unless it is full of course.
+	case eventqueue <- "manual": // Add reload to our queue channel, unless it is full of course.
 		w.WriteHeader(202)
 		fmt.Fprintln(w, "queued")
 		return
@@ -246,6 +346,9 @@ func nixyHealth(w http.ResponseWriter, r *http.Request) {
 		health.Config.Message = "OK"
 		health.Config.Healthy = true
 	}
+	if !health.Reload.Healthy {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
 	allBackendsDown := true
 	for _, endpoint := range health.Endpoints {
 		if endpoint.Healthy {
@@ -264,7 +367,9 @@ func nixyHealth(w http.ResponseWriter, r *http.Request) {
 
 func nixyConfig(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Content-Type", "application/json; charset=utf-8")
-	b, _ := json.MarshalIndent(&config, "", "  ")
+	config.RLock()
+	b, _ := json.MarshalIndent(config.redacted(), "", "  ")
+	config.RUnlock()
 	w.Write(b)
 	return
 }
@@ -276,31 +381,81 @@ func nixyVersion(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// loadConfig reads the toml config file.
+func loadConfig(path string) error {
+	file, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	err = toml.Unmarshal(file, &config)
+	if err != nil {
+		return err
+	}
+	// Lets default empty Xproxy to hostname.
+	if config.Xproxy == "" {
+		config.Xproxy, _ = os.Hostname()
+	}
+	return nil
+}
+
 func main() {
-	configtoml := flag.String("f", "nixy.toml", "Path to config. (default nixy.toml)")
-	versionflag := flag.Bool("v", false, "prints current nixy version")
-	flag.Parse()
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, ok := commands[args[0]]
+		if !ok {
+			usage()
+			os.Exit(2)
+		}
+		os.Exit(cmd(args[1:]))
+	}
+	// without a command nixy serves, as it always did.
+	os.Exit(serveCmd(args))
+}
+
+// serveCmd runs nixy.
+func serveCmd(args []string) int {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	configtoml := flags.String("f", "nixy.toml", "Path to config. (default nixy.toml)")
+	versionflag := flags.Bool("v", false, "prints current nixy version")
+	flags.Parse(args)
 	if *versionflag {
-		fmt.Printf("version: %s\n", version)
-		fmt.Printf("commit: %s\n", commit)
-		fmt.Printf("date: %s\n", date)
-		os.Exit(0)
+		return versionCmd(nil)
 	}
-	file, err := ioutil.ReadFile(*configtoml)
+	err := loadConfig(*configtoml)
 	if err != nil {
 		logger.WithFields(logrus.Fields{
 			"error": err.Error(),
-		}).Fatal("problem opening toml config")
+		}).Fatal("problem loading config")
 	}
-	err = toml.Unmarshal(file, &config)
+	err = setupTLS()
 	if err != nil {
 		logger.WithFields(logrus.Fields{
 			"error": err.Error(),
-		}).Fatal("problem parsing config")
+		}).Fatal("problem setting up marathon tls")
 	}
-	// Lets default empty Xproxy to hostname.
-	if config.Xproxy == "" {
-		config.Xproxy, _ = os.Hostname()
+	auth, err = setupAuth()
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Fatal("problem setting up marathon authentication")
+	}
+	proxy, err = setupProxy()
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Fatal("problem setting up proxy")
+	}
+	upstreams, err = setupUpstreams()
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Fatal("problem setting up dynamic upstreams")
+	}
+	err = setupAPIAuth()
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Fatal("problem setting up api authentication")
 	}
 	statsd, err = setupStatsd()
 	if err != nil {
@@ -310,23 +465,49 @@ func main() {
 		statsd = g2s.Noop() //fallback to Noop.
 	}
 	setupPrometheusMetrics()
-	mux := mux.NewRouter()
-	mux.HandleFunc("/", nixyVersion)
-	mux.HandleFunc("/v1/reload", nixyReload)
-	mux.HandleFunc("/v1/config", nixyConfig)
-	mux.HandleFunc("/v1/health", nixyHealth)
-	mux.Handle("/v1/metrics", promhttp.Handler())
 	s := &http.Server{
 		Addr:    ":" + config.Port,
-		Handler: mux,
+		Handler: apiRouter(),
 	}
 	health = newHealth()
+	loaded, err := loadSnapshot()
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("unable to load state snapshot")
+	}
+	if loaded {
+		// sync right away, the snapshot is rendered if marathon is unreachable.
+		eventqueue <- "startup"
+	}
 	endpointHealth()
 	eventStream()
 	eventWorker()
+	watchTemplates()
 	logger.Info("starting nixy on :" + config.Port)
 	err = s.ListenAndServe()
 	if err != nil {
 		log.Fatal(err)
 	}
+	return 0
+}
+
+// apiRouter returns the routes of the nixy API.
+func apiRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/", nixyVersion)
+	r.HandleFunc("/v1/reload", nixyReload)
+	r.HandleFunc("/v1/config", nixyConfig)
+	r.HandleFunc("/v1/health", nixyHealth)
+	r.HandleFunc("/v1/apps", nixyApps)
+	r.HandleFunc("/v1/apps/{id:.+}", nixyApp)
+	r.HandleFunc("/v1/exclusions", nixyExclusions)
+	r.HandleFunc("/v1/render", nixyRender).Methods("POST")
+	r.HandleFunc("/v1/history", nixyHistory)
+	r.HandleFunc("/v1/history/{id:[0-9]+}", nixyHistoryRevision)
+	r.HandleFunc("/v1/history/{id:[0-9]+}/diff", nixyHistoryDiff)
+	r.HandleFunc("/v1/history/{id:[0-9]+}/restore", nixyHistoryRestore).Methods("POST")
+	r.Handle("/v1/metrics", promhttp.Handler())
+	r.Use(apiAuthMiddleware)
+	return r
 }
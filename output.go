@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Output is a template rendered to its own file. The first output is the
+// main nginx config, checked with nginx -t after all outputs are in place.
+type Output struct {
+	Template       string
+	Config         string
+	LeftDelimiter  string `toml:"left_delimiter"`
+	RightDelimiter string `toml:"right_delimiter"`
+	Realm          string
+}
+
+// outputs returns the configured outputs, or the single output given by
+// nginx_template and nginx_config.
+func outputs() []Output {
+	// a copy, callers may run concurrently and only hold a read lock.
+	outs := append([]Output(nil), config.Outputs...)
+	if len(outs) == 0 {
+		outs = []Output{{
+			Template: config.NginxTemplate,
+			Config:   config.NginxConfig,
+		}}
+	}
+	for i := range outs {
+		if outs[i].LeftDelimiter == "" {
+			outs[i].LeftDelimiter = config.LeftDelimiter
+		}
+		if outs[i].RightDelimiter == "" {
+			outs[i].RightDelimiter = config.RightDelimiter
+		}
+	}
+	return outs
+}
+
+// realmOutputs is true if every output renders a single realm, so apps in
+// different realms may share subdomains.
+func realmOutputs() bool {
+	if len(config.Outputs) == 0 {
+		return false
+	}
+	for _, o := range config.Outputs {
+		if o.Realm == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// forOutput returns the template data of an output, only the apps of its
+// realm if it has one.
+func (c *Config) forOutput(o Output) *Config {
+	if o.Realm == "" {
+		return c
+	}
+	apps := make(map[string]App)
+	for id, app := range c.Apps {
+		if app.Labels["NIXY_REALM"] == o.Realm {
+			apps[id] = app
+		}
+	}
+	return &Config{
+		Xproxy:      c.Xproxy,
+		Realm:       o.Realm,
+		Statsd:      c.Statsd,
+		LastUpdates: c.LastUpdates,
+		Apps:        apps,
+	}
+}
+
+// installConf moves rendered configs in place of the live ones, keyed by
+// output path. A single config is checked before it replaces the live one,
+// several are checked together once in place and rolled back on failure.
+func installConf(files map[string][]byte) error {
+	outs := outputs()
+	for _, o := range outs {
+		if _, ok := files[o.Config]; !ok {
+			return errors.New("no config rendered for " + o.Config)
+		}
+	}
+	main := outs[0].Config
+	tmpFiles := make(map[string]string)
+	defer func() {
+		// keep the main config around if it failed, for the health check.
+		for _, name := range tmpFiles {
+			if name != lastConfig {
+				os.Remove(name)
+			}
+		}
+	}()
+	for _, o := range outs {
+		tmpFile, err := ioutil.TempFile(filepath.Dir(o.Config), ".nginx.conf.tmp-")
+		if err != nil {
+			return err
+		}
+		tmpFiles[o.Config] = tmpFile.Name()
+		_, err = tmpFile.Write(files[o.Config])
+		if closeErr := tmpFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	lastConfig = tmpFiles[main]
+	if len(outs) == 1 {
+		err := checkConf(tmpFiles[main])
+		if err != nil {
+			return err
+		}
+	}
+	for _, o := range outs {
+		err := backupConf(o.Config)
+		if err != nil {
+			return err
+		}
+	}
+	for _, o := range outs {
+		err := os.Rename(tmpFiles[o.Config], o.Config)
+		if err != nil {
+			return err
+		}
+		delete(tmpFiles, o.Config)
+	}
+	lastConfig = main
+	if len(outs) > 1 {
+		err := checkConf(main)
+		if err != nil {
+			rerr := rollbackConf()
+			if rerr != nil {
+				return fmt.Errorf("%v, and unable to roll back: %v", err, rerr)
+			}
+			return err
+		}
+	}
+	return nil
+}
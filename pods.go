@@ -0,0 +1,185 @@
+package main
+
+import (
+	"strings"
+)
+
+// MarathonPods struct for pod definitions from /v2/pods.
+type MarathonPods []MarathonPod
+
+// MarathonPod struct
+type MarathonPod struct {
+	ID          string                 `json:"id"`
+	Labels      map[string]string      `json:"labels"`
+	Environment map[string]interface{} `json:"environment"`
+	Networks    []MarathonNetwork      `json:"networks"`
+	Containers  []struct {
+		Name      string `json:"name"`
+		Endpoints []struct {
+			Name          string            `json:"name"`
+			ContainerPort int64             `json:"containerPort"`
+			HostPort      int64             `json:"hostPort"`
+			Protocol      []string          `json:"protocol"`
+			Labels        map[string]string `json:"labels"`
+		} `json:"endpoints"`
+		HealthCheck *struct {
+			HTTP *struct {
+				Path string `json:"path"`
+			} `json:"http"`
+		} `json:"healthCheck"`
+	} `json:"containers"`
+}
+
+// MarathonPodStatuses struct for pod instances from /v2/pods/::status.
+type MarathonPodStatuses []MarathonPodStatus
+
+// MarathonPodStatus struct
+type MarathonPodStatus struct {
+	ID        string `json:"id"`
+	Instances []struct {
+		ID            string `json:"id"`
+		Status        string `json:"status"`
+		AgentHostname string `json:"agentHostname"`
+		AgentID       string `json:"agentId"`
+		SpecReference string `json:"specReference"`
+		LastChanged   string `json:"lastChanged"`
+		Networks      []struct {
+			Name      string   `json:"name"`
+			Addresses []string `json:"addresses"`
+		} `json:"networks"`
+		Containers []struct {
+			Name      string `json:"name"`
+			Status    string `json:"status"`
+			Endpoints []struct {
+				Name              string `json:"name"`
+				AllocatedHostPort int64  `json:"allocatedHostPort"`
+				Healthy           *bool  `json:"healthy"`
+			} `json:"endpoints"`
+		} `json:"containers"`
+	} `json:"instances"`
+}
+
+// fetchPods adds all pods to apps. Marathon versions without pods respond
+// with 404, which is not an error.
+func fetchPods(apps map[string]MarathonApp) error {
+	pods := MarathonPods{}
+	found, err := fetchJSON("/v2/pods", &pods)
+	if err != nil || !found {
+		return err
+	}
+	statuses := MarathonPodStatuses{}
+	_, err = fetchJSON("/v2/pods/::status", &statuses)
+	if err != nil {
+		return err
+	}
+	byID := make(map[string]MarathonPodStatus)
+	for _, status := range statuses {
+		byID[status.ID] = status
+	}
+	for _, pod := range pods {
+		apps[pod.ID] = podToApp(pod, byID[pod.ID])
+	}
+	return nil
+}
+
+// fetchPod fetches a single pod with its instances, returns nil if it does
+// not exist.
+func fetchPod(id string) (*MarathonApp, error) {
+	pod := MarathonPod{}
+	found, err := fetchJSON("/v2/pods/"+escapeID(id), &pod)
+	if err != nil || !found {
+		return nil, err
+	}
+	status := MarathonPodStatus{}
+	_, err = fetchJSON("/v2/pods/"+escapeID(id)+"::status", &status)
+	if err != nil {
+		return nil, err
+	}
+	app := podToApp(pod, status)
+	return &app, nil
+}
+
+// podToApp maps a pod to an app, so it is filtered and rendered the same
+// way. Every pod instance becomes a task, with the allocated host ports of
+// all container endpoints as its ports.
+func podToApp(pod MarathonPod, status MarathonPodStatus) MarathonApp {
+	app := MarathonApp{
+		ID:       pod.ID,
+		Labels:   pod.Labels,
+		Env:      make(map[string]string),
+		Networks: pod.Networks,
+		pod:      true,
+	}
+	for k, v := range pod.Environment {
+		// secrets are objects, only plain values are kept.
+		if s, ok := v.(string); ok {
+			app.Env[k] = s
+		}
+	}
+	containerPorts := make(map[string]int64)
+	for _, c := range pod.Containers {
+		for _, ep := range c.Endpoints {
+			containerPorts[c.Name+"/"+ep.Name] = ep.ContainerPort
+		}
+		if c.HealthCheck != nil {
+			var path string
+			if c.HealthCheck.HTTP != nil {
+				path = c.HealthCheck.HTTP.Path
+			}
+			app.HealthChecks = append(app.HealthChecks, MarathonHealthCheck{Path: path})
+		}
+	}
+	for _, instance := range status.Instances {
+		task := MarathonTask{
+			AppID:     pod.ID,
+			Host:      instance.AgentHostname,
+			ID:        instance.ID,
+			SlaveID:   instance.AgentID,
+			StartedAt: instance.LastChanged,
+			State:     "TASK_RUNNING",
+			Version:   instance.SpecReference,
+			Endpoints: make(map[string]int64),
+		}
+		task.ContainerEndpoints = make(map[string]int64)
+		if len(instance.Containers) == 0 {
+			task.State = instance.Status
+		}
+		alive := instance.Status == "STABLE"
+		for _, c := range instance.Containers {
+			if c.Status != "TASK_RUNNING" {
+				task.State = c.Status
+			}
+			for _, ep := range c.Endpoints {
+				containerPort := containerPorts[c.Name+"/"+ep.Name]
+				if ep.AllocatedHostPort == 0 && containerPort == 0 {
+					continue
+				}
+				if ep.Healthy != nil && !*ep.Healthy {
+					alive = false
+				}
+				if ep.AllocatedHostPort > 0 {
+					task.Ports = append(task.Ports, ep.AllocatedHostPort)
+					task.Endpoints[ep.Name] = ep.AllocatedHostPort
+				}
+				if containerPort > 0 {
+					task.ContainerPorts = append(task.ContainerPorts, containerPort)
+					task.ContainerEndpoints[ep.Name] = containerPort
+				}
+			}
+		}
+		for _, n := range instance.Networks {
+			for _, ip := range n.Addresses {
+				protocol := "IPv4"
+				if strings.Contains(ip, ":") {
+					protocol = "IPv6"
+				}
+				task.IPAddresses = append(task.IPAddresses, MarathonIPAddress{IPAddress: ip, Protocol: protocol})
+			}
+		}
+		if len(app.HealthChecks) > 0 {
+			task.HealthCheckResults = []MarathonHealthCheckResult{{Alive: alive}}
+		}
+		app.Tasks = append(app.Tasks, task)
+	}
+	return app
+}
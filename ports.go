@@ -0,0 +1,85 @@
+package main
+
+// portInfo is the name and labels of a port, in the same order as the
+// ports of a task.
+type portInfo struct {
+	name   string
+	labels map[string]string
+}
+
+// portInfos returns the port names and labels matching the target ports
+// of the tasks of an app.
+func portInfos(app MarathonApp, network string) []portInfo {
+	var infos []portInfo
+	if network == networkContainer {
+		for _, pm := range app.portMappings() {
+			infos = append(infos, portInfo{name: pm.Name, labels: pm.Labels})
+		}
+		if len(infos) == 0 && app.IPAddress != nil {
+			for _, p := range app.IPAddress.Discovery.Ports {
+				infos = append(infos, portInfo{name: p.Name})
+			}
+		}
+		return infos
+	}
+	for _, pd := range app.PortDefinitions {
+		infos = append(infos, portInfo{name: pd.Name, labels: pd.Labels})
+	}
+	if len(infos) == 0 {
+		// bridge networking, host ports follow the port mappings.
+		for _, pm := range app.portMappings() {
+			infos = append(infos, portInfo{name: pm.Name, labels: pm.Labels})
+		}
+	}
+	return infos
+}
+
+// namedPorts maps port names to the target ports of a task and picks the
+// primary port. The primary port is the one named by the NIXY_PORT_NAME
+// app label, else the one with the NIXY_PRIMARY port label, else the first.
+func namedPorts(app MarathonApp, task MarathonTask, network string, ports []int64) (map[string]int64, int64, bool) {
+	named := make(map[string]int64)
+	var primary int64
+	if app.pod {
+		// pod endpoints are named already.
+		endpoints := task.Endpoints
+		if network == networkContainer {
+			endpoints = task.ContainerEndpoints
+		}
+		for name, port := range endpoints {
+			named[name] = port
+		}
+	} else {
+		for i, info := range portInfos(app, network) {
+			if i >= len(ports) {
+				break
+			}
+			if info.name != "" {
+				named[info.name] = ports[i]
+			}
+			if primary == 0 && info.labels["NIXY_PRIMARY"] == "true" {
+				primary = ports[i]
+			}
+		}
+	}
+	if name, ok := app.Labels["NIXY_PORT_NAME"]; ok {
+		port, found := named[name]
+		if !found {
+			return named, ports[0], false
+		}
+		return named, port, true
+	}
+	if primary == 0 {
+		primary = ports[0]
+	}
+	return named, primary, true
+}
+
+// portByName is a template function returning the port with the given
+// name, or the primary port if the task has no port with that name.
+func portByName(task Task, name string) int64 {
+	if port, ok := task.NamedPorts[name]; ok {
+		return port
+	}
+	return task.Port
+}
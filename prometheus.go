@@ -23,6 +23,27 @@ var (
 			Help:      "Total number of successful Nginx reloads",
 		},
 	)
+	countRollbacks = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: ns,
+			Name:      "rollbacks",
+			Help:      "Total number of rollbacks to the last good config after a failed Nginx reload",
+		},
+	)
+	countUpstreamUpdates = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: ns,
+			Name:      "upstream_updates",
+			Help:      "Total number of upstream updates pushed to Nginx without a reload",
+		},
+	)
+	countUpstreamUpdateErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: ns,
+			Name:      "upstream_update_errors",
+			Help:      "Total number of failed upstream updates",
+		},
+	)
 	histogramReloadDuration = prometheus.NewHistogram(
 		prometheus.HistogramOpts{
 			Namespace: ns,
@@ -31,6 +52,42 @@ var (
 			Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
 		},
 	)
+	histogramCoalescedEvents = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: ns,
+			Name:      "reload_coalesced_events",
+			Help:      "Number of events coalesced into a single reload",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 10),
+		},
+	)
+	countTemplateErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: ns,
+			Name:      "template_errors",
+			Help:      "Total number of invalid templates found when watching the template files",
+		},
+	)
+	countSnapshotErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: ns,
+			Name:      "snapshot_errors",
+			Help:      "Total number of errors writing the state snapshot",
+		},
+	)
+	gaugeServingSnapshot = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: ns,
+			Name:      "serving_stale_snapshot",
+			Help:      "Whether apps are served from the state snapshot instead of Marathon",
+		},
+	)
+	gaugeSnapshotTimestamp = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: ns,
+			Name:      "snapshot_timestamp_seconds",
+			Help:      "Time the state snapshot in use was written",
+		},
+	)
 	countInvalidSubdomainLabelWarnings = prometheus.NewCounter(
 		prometheus.CounterOpts{
 			Namespace: ns,
@@ -45,6 +102,36 @@ var (
 			Help:      "Total number of warnings about duplicate subdomain label",
 		},
 	)
+	countPortNameNotFoundWarnings = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: ns,
+			Name:      "port_name_not_found_warnings",
+			Help:      "Total number of warnings about NIXY_PORT_NAME not matching any port",
+		},
+	)
+	countSnippetsRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: ns,
+			Name:      "snippets_rejected",
+			Help:      "Total number of app snippets rejected by the directive allowlist",
+		},
+		[]string{"snippet"},
+	)
+	gaugeExclusions = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: ns,
+			Name:      "exclusions",
+			Help:      "Number of apps and tasks not routed in the last sync, by reason",
+		},
+		[]string{"reason"},
+	)
+	countAPIAuthFailures = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: ns,
+			Name:      "api_auth_failures",
+			Help:      "Total number of API requests refused for missing, invalid or insufficient credentials",
+		},
+	)
 	countEndpointCheckFails = prometheus.NewCounter(
 		prometheus.CounterOpts{
 			Namespace: ns,
@@ -80,11 +167,70 @@ var (
 			Help:      "Total number of warnings about no data in Marathon stream",
 		},
 	)
-	countMarathonEventsReceived = prometheus.NewCounter(
+	countAuthErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: ns,
+			Name:      "marathon_auth_errors",
+			Help:      "Total number of errors authenticating against Marathon",
+		},
+	)
+	countTLSReloadErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: ns,
+			Name:      "marathon_tls_reload_errors",
+			Help:      "Total number of errors reloading Marathon TLS certificates",
+		},
+	)
+	countLeaderResolveErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: ns,
+			Name:      "marathon_leader_resolve_errors",
+			Help:      "Total number of errors resolving the Marathon leader",
+		},
+	)
+	gaugeMarathonLeader = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: ns,
+			Name:      "marathon_leader",
+			Help:      "Current Marathon leader used by nixy",
+		},
+		[]string{"leader"},
+	)
+	countMarathonEventsReceived = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: ns,
 			Name:      "marathon_events_received",
-			Help:      "Total number of received Marathon events",
+			Help:      "Total number of received Marathon events by event type",
+		},
+		[]string{"event_type"},
+	)
+	countMarathonEventsIgnored = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: ns,
+			Name:      "marathon_events_ignored",
+			Help:      "Total number of filtered out Marathon events by event type",
+		},
+		[]string{"event_type"},
+	)
+	countMarathonDeltasApplied = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: ns,
+			Name:      "marathon_deltas_applied",
+			Help:      "Total number of Marathon events applied directly to the known state",
+		},
+	)
+	countMarathonDeltasFailed = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: ns,
+			Name:      "marathon_deltas_failed",
+			Help:      "Total number of Marathon events that required the app to be fetched again",
+		},
+	)
+	countMarathonFullResyncs = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: ns,
+			Name:      "marathon_full_resyncs",
+			Help:      "Total number of full app fetches from Marathon",
 		},
 	)
 )
@@ -92,17 +238,41 @@ var (
 func setupPrometheusMetrics() {
 	prometheus.MustRegister(countFailedReloads)
 	prometheus.MustRegister(countSuccessfulReloads)
+	prometheus.MustRegister(countRollbacks)
+	prometheus.MustRegister(countUpstreamUpdates)
+	prometheus.MustRegister(countUpstreamUpdateErrors)
 	prometheus.MustRegister(histogramReloadDuration)
+	prometheus.MustRegister(histogramCoalescedEvents)
+	prometheus.MustRegister(countTemplateErrors)
+	prometheus.MustRegister(countSnapshotErrors)
+	prometheus.MustRegister(gaugeServingSnapshot)
+	prometheus.MustRegister(gaugeSnapshotTimestamp)
 	prometheus.MustRegister(countInvalidSubdomainLabelWarnings)
 	prometheus.MustRegister(countDuplicateSubdomainLabelWarnings)
+	prometheus.MustRegister(countPortNameNotFoundWarnings)
+	prometheus.MustRegister(countSnippetsRejected)
+	prometheus.MustRegister(gaugeExclusions)
+	prometheus.MustRegister(countAPIAuthFailures)
 	prometheus.MustRegister(countEndpointCheckFails)
 	prometheus.MustRegister(countEndpointDownErrors)
 	prometheus.MustRegister(countAllEndpointsDownErrors)
 	prometheus.MustRegister(countMarathonStreamErrors)
 	prometheus.MustRegister(countMarathonStreamNoDataWarnings)
+	prometheus.MustRegister(countAuthErrors)
+	prometheus.MustRegister(countTLSReloadErrors)
+	prometheus.MustRegister(countLeaderResolveErrors)
+	prometheus.MustRegister(gaugeMarathonLeader)
 	prometheus.MustRegister(countMarathonEventsReceived)
+	prometheus.MustRegister(countMarathonEventsIgnored)
+	prometheus.MustRegister(countMarathonDeltasApplied)
+	prometheus.MustRegister(countMarathonDeltasFailed)
+	prometheus.MustRegister(countMarathonFullResyncs)
 }
 
 func observeReloadTimeMetric(e time.Duration) {
 	histogramReloadDuration.Observe(float64(e) / float64(time.Second))
 }
+
+func observeCoalescedEventsMetric(n int) {
+	histogramCoalescedEvents.Observe(float64(n))
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ProxyDriver checks and reloads the proxy the configs are rendered for.
+type ProxyDriver interface {
+	// Check validates a rendered config before it goes live.
+	Check(path string) error
+	// Reload makes the proxy pick up the installed configs.
+	Reload() error
+}
+
+// HAProxyConfig settings for the haproxy driver.
+type HAProxyConfig struct {
+	Cmd          string
+	PidFile      string `toml:"pid_file"`
+	MasterSocket string `toml:"master_socket"`
+}
+
+var proxy ProxyDriver = &nginxDriver{}
+
+func setupProxy() (ProxyDriver, error) {
+	switch config.Proxy {
+	case "", "nginx":
+		switch config.NginxReload {
+		case "", "exec":
+			return &nginxDriver{}, nil
+		case "signal":
+			if config.NginxPidFile == "" {
+				config.NginxPidFile = "/run/nginx.pid"
+			}
+			return &nginxDriver{pidFile: config.NginxPidFile}, nil
+		}
+		return nil, fmt.Errorf("unknown nginx reload strategy %q", config.NginxReload)
+	case "haproxy":
+		if config.HAProxy.Cmd == "" {
+			config.HAProxy.Cmd = "haproxy"
+		}
+		if config.HAProxy.PidFile == "" && config.HAProxy.MasterSocket == "" {
+			return nil, errors.New("haproxy needs a pid_file or master_socket to reload")
+		}
+		return &haproxyDriver{config.HAProxy}, nil
+	}
+	return nil, fmt.Errorf("unknown proxy %q", config.Proxy)
+}
+
+// runCmd runs a command line from the config with extra arguments, the
+// command line may have arguments as well. Example "docker exec nginx..."
+func runCmd(cmdline string, extra ...string) error {
+	args := strings.Fields(cmdline)
+	if len(args) == 0 {
+		return errors.New("no command configured")
+	}
+	cmd := exec.Command(args[0], append(args[1:], extra...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run() // will wait for command to return
+	if err != nil {
+		return errors.New(fmt.Sprint(err) + ": " + stderr.String())
+	}
+	return nil
+}
+
+// nginxDriver runs nginx -t, and nginx -s reload or sends SIGHUP to the
+// master process if a pid file is set.
+type nginxDriver struct {
+	pidFile string
+}
+
+func (d *nginxDriver) Check(path string) error {
+	return runCmd(config.NginxCmd, "-c", path, "-t")
+}
+
+func (d *nginxDriver) Reload() error {
+	if d.pidFile != "" {
+		return signalReload(d.pidFile)
+	}
+	return runCmd(config.NginxCmd, "-s", "reload")
+}
+
+func readPid(pidFile string) (int, error) {
+	b, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid pid in %s: %v", pidFile, err)
+	}
+	return pid, nil
+}
+
+// signalReload sends SIGHUP to the master process in the pid file. nginx
+// keeps the master and its old workers if it rejects the new config, so the
+// reload only succeeds once the master started new workers.
+func signalReload(pidFile string) error {
+	pid, err := readPid(pidFile)
+	if err != nil {
+		return err
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	workers, err := childPids(pid)
+	if err != nil {
+		return fmt.Errorf("unable to find the workers of nginx master %d: %v", pid, err)
+	}
+	err = process.Signal(syscall.SIGHUP)
+	if err != nil {
+		return fmt.Errorf("unable to signal nginx master %d: %v", pid, err)
+	}
+	deadline := time.Now().Add(reloadTimeout)
+	for {
+		time.Sleep(100 * time.Millisecond)
+		err = process.Signal(syscall.Signal(0))
+		if err != nil {
+			return fmt.Errorf("nginx master %d did not survive the reload: %v", pid, err)
+		}
+		current, err := readPid(pidFile)
+		if err != nil {
+			return err
+		}
+		if current != pid {
+			return fmt.Errorf("nginx master changed from %d to %d during reload", pid, current)
+		}
+		children, err := childPids(pid)
+		if err != nil {
+			return err
+		}
+		for child := range children {
+			if !workers[child] {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("nginx master %d started no new workers, the config was not loaded", pid)
+		}
+	}
+}
+
+// reloadTimeout is how long nginx has to start new workers after a SIGHUP.
+var reloadTimeout = 5 * time.Second
+
+// childPids returns the processes with parent pid, read from /proc.
+func childPids(pid int) (map[int]bool, error) {
+	dirs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	children := make(map[int]bool)
+	for _, dir := range dirs {
+		child, err := strconv.Atoi(dir.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := ioutil.ReadFile(filepath.Join("/proc", dir.Name(), "stat"))
+		if err != nil {
+			// the process exited meanwhile.
+			continue
+		}
+		// the command in parentheses may have spaces, the state and
+		// parent pid follow it.
+		fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+		if len(fields) > 1 && fields[1] == strconv.Itoa(pid) {
+			children[child] = true
+		}
+	}
+	return children, nil
+}
+
+// haproxyDriver loads every output with its own -f, as haproxy has no
+// include. It reloads through the master cli if haproxy runs in
+// master-worker mode, or starts a new haproxy taking over from the old one.
+type haproxyDriver struct {
+	HAProxyConfig
+}
+
+// configArgs returns -f for the main config at path and all other outputs.
+func (d *haproxyDriver) configArgs(path string) []string {
+	args := []string{"-f", path}
+	for _, o := range outputs()[1:] {
+		args = append(args, "-f", o.Config)
+	}
+	return args
+}
+
+func (d *haproxyDriver) Check(path string) error {
+	return runCmd(d.Cmd, append([]string{"-c"}, d.configArgs(path)...)...)
+}
+
+func (d *haproxyDriver) Reload() error {
+	if d.MasterSocket != "" {
+		return d.reloadMaster()
+	}
+	args := append(d.configArgs(outputs()[0].Config), "-p", d.PidFile, "-D")
+	pids, err := ioutil.ReadFile(d.PidFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// no pid file, haproxy is not running yet.
+	if fields := strings.Fields(string(pids)); len(fields) > 0 {
+		args = append(args, "-sf")
+		args = append(args, fields...)
+	}
+	return runCmd(d.Cmd, args...)
+}
+
+// reloadMaster sends reload to the master cli. Newer versions answer with
+// the result of the reload, older ones just close the connection.
+func (d *haproxyDriver) reloadMaster() error {
+	conn, err := net.DialTimeout("unix", d.MasterSocket, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	_, err = conn.Write([]byte("reload\n"))
+	if err != nil {
+		return err
+	}
+	resp, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return err
+	}
+	if strings.Contains(string(resp), "Success=0") {
+		return errors.New("haproxy reload failed: " + strings.TrimSpace(string(resp)))
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeNginx starts a shell that runs like an nginx master, with a worker
+// and the given trap for SIGHUP, and writes its pid file.
+func fakeNginx(t *testing.T, trap string) (string, func()) {
+	dir, err := ioutil.TempDir("", "nixy-signal-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pidFile := filepath.Join(dir, "nginx.pid")
+	cmd := exec.Command("/bin/sh", "-c", "sleep 10 & trap '"+trap+"' HUP; echo $$ > "+pidFile+"; while :; do wait; done")
+	err = cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// wait for the trap and the first worker.
+	for i := 0; i < 50; i++ {
+		pid, err := readPid(pidFile)
+		if children, _ := childPids(cmd.Process.Pid); err == nil && pid == cmd.Process.Pid && len(children) > 0 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return pidFile, func() {
+		children, _ := childPids(cmd.Process.Pid)
+		for child := range children {
+			if p, err := os.FindProcess(child); err == nil {
+				p.Kill()
+			}
+		}
+		cmd.Process.Kill()
+		cmd.Wait()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSignalReload(t *testing.T) {
+	if _, err := os.Stat("/proc/self/stat"); err != nil {
+		t.Skip("no /proc")
+	}
+	defer func(old time.Duration) { reloadTimeout = old }(reloadTimeout)
+	reloadTimeout = time.Second
+
+	// new workers are started when the config is loaded.
+	pidFile, stop := fakeNginx(t, "sleep 10 &")
+	err := signalReload(pidFile)
+	stop()
+	if err != nil {
+		t.Errorf("reload with new workers failed: %v", err)
+	}
+
+	// the old workers keep running when the config is rejected.
+	pidFile, stop = fakeNginx(t, ":")
+	err = signalReload(pidFile)
+	stop()
+	if err == nil {
+		t.Error("reload without new workers succeeded")
+	}
+
+	// the master is gone.
+	pidFile, stop = fakeNginx(t, "exit 1")
+	err = signalReload(pidFile)
+	stop()
+	if err == nil {
+		t.Error("reload with the master gone succeeded")
+	}
+}
+
+func TestChildPids(t *testing.T) {
+	if _, err := os.Stat("/proc/self/stat"); err != nil {
+		t.Skip("no /proc")
+	}
+	cmd := exec.Command("sleep", "10")
+	err := cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+	children, err := childPids(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !children[cmd.Process.Pid] {
+		t.Errorf("child %d not found in %v", cmd.Process.Pid, children)
+	}
+	if children[os.Getpid()] {
+		t.Error("process is its own child")
+	}
+}
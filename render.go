@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"text/template"
+)
+
+// Preview of a rendered template and the result of the config check.
+type Preview struct {
+	Config  string
+	Valid   bool
+	Message string
+}
+
+// renderPreview renders a template file with the known apps, like the
+// first output, and checks the result without installing it.
+func renderPreview(tmpl string, funcs template.FuncMap) (*Preview, error) {
+	o := outputs()[0]
+	o.Template = tmpl
+	t, err := parseTmpl(o, funcs)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	config.RLock()
+	err = t.Execute(&buf, config.forOutput(o))
+	config.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	preview := &Preview{Config: buf.String(), Valid: true, Message: "OK"}
+	err = checkPreview(buf.Bytes(), filepath.Dir(o.Config))
+	if err != nil {
+		preview.Valid = false
+		preview.Message = err.Error()
+	}
+	return preview, nil
+}
+
+// checkPreview checks a config in a temporary file next to the live one,
+// so relative paths in it resolve the same way.
+func checkPreview(conf []byte, dir string) error {
+	tmpFile, err := ioutil.TempFile(dir, ".nginx.conf.preview-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.Write(conf)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return checkConf(tmpFile.Name())
+}
+
+// apiFuncs are the template functions for templates posted to the API, the
+// environment of nixy is not exposed to them.
+func apiFuncs() template.FuncMap {
+	funcs := templateFuncs()
+	funcs["getenv"] = func(string) string { return "" }
+	return funcs
+}
+
+// nixyRender renders the template in the request body with the current apps.
+// Rendered configs are checked with nginx, so an open API only renders if
+// it is enabled explicitly, otherwise it needs the admin scope.
+func nixyRender(w http.ResponseWriter, r *http.Request) {
+	if !apiAuthEnabled() && !config.API.Render {
+		http.Error(w, "render is disabled, configure api credentials or set render in [api]", http.StatusForbidden)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		http.Error(w, "empty template", http.StatusBadRequest)
+		return
+	}
+	tmpFile, err := ioutil.TempFile("", "nixy-render-")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.Write(body)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	preview, err := renderPreview(tmpFile.Name(), apiFuncs())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	b, _ := json.MarshalIndent(preview, "", "  ")
+	w.Write(b)
+	return
+}
+
+// renderCmd renders a template with the apps of a state snapshot to stdout,
+// the config check result goes to stderr.
+func renderCmd(args []string) int {
+	flags := flag.NewFlagSet("render", flag.ExitOnError)
+	configtoml := flags.String("f", "nixy.toml", "Path to config.")
+	tmpl := flags.String("template", "", "Template to render, defaults to the template of the first output.")
+	state := flags.String("state", "", "State snapshot with the apps to render, defaults to state_file.")
+	flags.Parse(args)
+	err := loadConfig(*configtoml)
+	if err == nil {
+		proxy, err = setupProxy()
+	}
+	if err == nil {
+		err = loadApps(*state)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "problem loading config: "+err.Error())
+		return 1
+	}
+	if *tmpl == "" {
+		*tmpl = outputs()[0].Template
+	}
+	preview, err := renderPreview(*tmpl, templateFuncs())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "unable to render template: "+err.Error())
+		return 1
+	}
+	fmt.Print(preview.Config)
+	if !preview.Valid {
+		fmt.Fprintln(os.Stderr, "config check failed: "+preview.Message)
+		return 1
+	}
+	return 0
+}
+
+// loadApps sets the apps from a state snapshot.
+func loadApps(path string) error {
+	if path == "" {
+		path = config.StateFile
+	}
+	if path == "" {
+		return errors.New("no state snapshot, set --state or state_file")
+	}
+	snap, err := readSnapshot(path)
+	if err != nil {
+		return err
+	}
+	config.Apps = snap.Apps
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// backupPath is where the last config nginx accepted is kept.
+func backupPath(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".last-good")
+}
+
+// backupConf keeps a copy of the current config before it is replaced.
+func backupConf(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		// first render, nothing to go back to.
+		os.Remove(backupPath(path))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), ".nginx.conf.tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.Write(b)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), backupPath(path))
+}
+
+// rollbackConf puts the last good config of every output back in place,
+// and removes outputs that had none so nginx does not load them later.
+func rollbackConf() error {
+	restored := false
+	var rerr error
+	for _, o := range outputs() {
+		err := os.Rename(backupPath(o.Config), o.Config)
+		if os.IsNotExist(err) {
+			err = os.Remove(o.Config)
+			if os.IsNotExist(err) {
+				err = nil
+			}
+		} else if err == nil {
+			restored = true
+		}
+		if err != nil && rerr == nil {
+			rerr = err
+		}
+	}
+	if rerr != nil {
+		return rerr
+	}
+	if !restored {
+		return errors.New("no previous config to roll back to")
+	}
+	lastConfig = outputs()[0].Config
+	return nil
+}
+
+// reloadOrRollback reloads nginx, and restores the last good config if
+// nginx refuses the new one, so a later restart does not pick it up.
+func reloadOrRollback() error {
+	err := reloadProxy()
+	if err == nil {
+		health.Reload.Healthy = true
+		health.Reload.Message = "OK"
+		return nil
+	}
+	health.Reload.Healthy = false
+	health.Reload.Message = err.Error()
+	rerr := rollbackConf()
+	if rerr != nil {
+		logger.WithFields(logrus.Fields{
+			"error": rerr.Error(),
+		}).Error("unable to roll back nginx config")
+		return err
+	}
+	logger.WithFields(logrus.Fields{
+		"error": err.Error(),
+	}).Warn("nginx reload failed, rolled back to last good config")
+	go countRollbacks.Inc()
+	history.rolledBack()
+	health.Reload.Message = "rolled back to last good config: " + err.Error()
+	return err
+}
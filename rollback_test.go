@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRollbackConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nixy-rollback-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(old []Output) { config.Outputs = old }(config.Outputs)
+	main := filepath.Join(dir, "nginx.conf")
+	include := filepath.Join(dir, "new.conf")
+	config.Outputs = []Output{{Config: main}, {Config: include}}
+
+	ioutil.WriteFile(main, []byte("good"), 0644)
+	for _, o := range config.Outputs {
+		err = backupConf(o.Config)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ioutil.WriteFile(main, []byte("bad"), 0644)
+	ioutil.WriteFile(include, []byte("bad"), 0644)
+
+	err = rollbackConf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(main); string(b) != "good" {
+		t.Errorf("main config %q, expected the last good one", b)
+	}
+	if _, err := os.Stat(include); !os.IsNotExist(err) {
+		t.Error("new output without a previous config left in place")
+	}
+}
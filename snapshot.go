@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Snapshot of the last synced apps, written to disk so nixy can render a
+// config after a restart while Marathon is unreachable.
+type Snapshot struct {
+	Timestamp time.Time
+	Endpoint  string
+	Version   string
+	Apps      map[string]App
+}
+
+// SnapshotStatus health status of the snapshot
+type SnapshotStatus struct {
+	Stale     bool
+	Timestamp time.Time
+	Endpoint  string
+}
+
+// snapshotState tracks if we are serving apps loaded from the snapshot.
+type snapshotState struct {
+	sync.Mutex
+	stale    bool
+	rendered bool
+}
+
+var snapshot snapshotState
+
+// writeSnapshot saves the synced apps atomically, config must be locked.
+func writeSnapshot(endpoint string) error {
+	if config.StateFile == "" {
+		return nil
+	}
+	snap := Snapshot{
+		Timestamp: time.Now(),
+		Endpoint:  endpoint,
+		Version:   version,
+		Apps:      config.Apps,
+	}
+	b, err := json.Marshal(&snap)
+	if err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(config.StateFile), ".nixy-state.tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.Write(b)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpFile.Name(), config.StateFile)
+	if err != nil {
+		return err
+	}
+	setSnapshotHealth(false, snap)
+	return nil
+}
+
+// loadSnapshot reads the snapshot into config.Apps, returns false if there
+// is no snapshot to load.
+func loadSnapshot() (bool, error) {
+	if config.StateFile == "" {
+		return false, nil
+	}
+	snap, err := readSnapshot(config.StateFile)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	config.Lock()
+	config.Apps = snap.Apps
+	config.Unlock()
+	// the first sync renders, even if Marathon has the same apps.
+	renderPending = true
+	snapshot.Lock()
+	snapshot.stale = true
+	snapshot.Unlock()
+	setSnapshotHealth(true, snap)
+	logger.WithFields(logrus.Fields{
+		"apps":      len(snap.Apps),
+		"timestamp": snap.Timestamp,
+		"endpoint":  snap.Endpoint,
+	}).Info("loaded state snapshot")
+	return true, nil
+}
+
+func readSnapshot(path string) (Snapshot, error) {
+	snap := Snapshot{}
+	file, err := ioutil.ReadFile(path)
+	if err != nil {
+		return snap, err
+	}
+	err = json.Unmarshal(file, &snap)
+	return snap, err
+}
+
+func setSnapshotHealth(stale bool, snap Snapshot) {
+	health.Snapshot = &SnapshotStatus{
+		Stale:     stale,
+		Timestamp: snap.Timestamp,
+		Endpoint:  snap.Endpoint,
+	}
+	if stale {
+		gaugeServingSnapshot.Set(1)
+	} else {
+		gaugeServingSnapshot.Set(0)
+	}
+	gaugeSnapshotTimestamp.Set(float64(snap.Timestamp.Unix()))
+}
+
+// snapshotSynced marks the apps as fresh from Marathon again.
+func snapshotSynced() {
+	snapshot.Lock()
+	defer snapshot.Unlock()
+	if !snapshot.stale {
+		return
+	}
+	snapshot.stale = false
+	if health.Snapshot != nil {
+		health.Snapshot.Stale = false
+	}
+	gaugeServingSnapshot.Set(0)
+}
+
+// renderSnapshot renders the snapshot apps once, when Marathon could not be
+// reached since nixy started.
+func renderSnapshot(trigger string) {
+	snapshot.Lock()
+	defer snapshot.Unlock()
+	if !snapshot.stale || snapshot.rendered {
+		return
+	}
+	snapshot.rendered = true
+	err := writeConf(trigger + ", snapshot")
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("unable to generate nginx config from snapshot")
+		return
+	}
+	config.LastUpdates.LastConfigValid = time.Now()
+	err = reloadOrRollback()
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("unable to reload nginx")
+		return
+	}
+	config.LastUpdates.LastNginxReload = time.Now()
+	logger.Warn("marathon unreachable, serving apps from state snapshot")
+}
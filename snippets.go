@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Labels with nginx directives added to the server and location of an app.
+const (
+	labelServerSnippet   = "NIXY_SERVER_SNIPPET"
+	labelLocationSnippet = "NIXY_LOCATION_SNIPPET"
+	labelSnippetBase64   = "NIXY_SNIPPET_BASE64"
+)
+
+// appSnippet returns the validated snippet of a label, an empty string if
+// the app has none or it was rejected.
+func appSnippet(app MarathonApp, name string, kind string) string {
+	snippet, ok := app.Labels[name]
+	if !ok || strings.TrimSpace(snippet) == "" {
+		return ""
+	}
+	snippet, err := decodeSnippet(snippet, app.Labels[labelSnippetBase64] == "true")
+	if err == nil {
+		snippet, err = validateSnippet(snippet, config.SnippetDirectives)
+	}
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"app":   app.ID,
+			"label": name,
+			"error": err.Error(),
+		}).Warn("snippet rejected")
+		go countSnippetsRejected.WithLabelValues(kind).Inc()
+		return ""
+	}
+	return snippet
+}
+
+func decodeSnippet(snippet string, encoded bool) (string, error) {
+	if !encoded {
+		return snippet, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(snippet))
+	if err != nil {
+		return "", fmt.Errorf("invalid base64: %v", err)
+	}
+	return string(b), nil
+}
+
+// validateSnippet checks that a snippet only has simple directives from the
+// allowlist, no blocks or comments, and returns them on a single line. It
+// reads quotes and escapes the way nginx does, quotes only start a string at
+// the start of a value.
+func validateSnippet(snippet string, allowed []string) (string, error) {
+	var directives []string
+	var current []rune
+	var quote rune
+	escaped := false
+	start := true
+	closed := false
+	for _, c := range snippet {
+		if closed && !nginxSpace(c) && c != ';' {
+			return "", errors.New("quoted string not followed by a space or ;")
+		}
+		closed = false
+		space := false
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+				closed = true
+			}
+		case nginxSpace(c):
+			space = true
+		case c == '"' || c == '\'':
+			if !start {
+				return "", errors.New("quotes are only allowed at the start of a value")
+			}
+			quote = c
+		case c == '{' || c == '}':
+			return "", errors.New("blocks are not allowed")
+		case c == '#':
+			return "", errors.New("comments are not allowed")
+		case c == ';':
+			directive := strings.TrimSpace(string(current))
+			if directive == "" {
+				return "", errors.New("empty directive")
+			}
+			directives = append(directives, directive+";")
+			current = current[:0]
+			start = true
+			continue
+		}
+		start = space
+		current = append(current, c)
+	}
+	if quote != 0 {
+		return "", errors.New("unterminated quote")
+	}
+	if strings.TrimSpace(string(current)) != "" || escaped {
+		return "", errors.New("directive not terminated by ;")
+	}
+	for _, d := range directives {
+		name := strings.Fields(d)[0]
+		name = strings.TrimSuffix(name, ";")
+		if !directiveAllowed(name, allowed) {
+			return "", fmt.Errorf("directive %q is not allowed", name)
+		}
+	}
+	return strings.Join(directives, " "), nil
+}
+
+// nginxSpace is true for the characters nginx separates values with.
+func nginxSpace(c rune) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+func directiveAllowed(name string, allowed []string) bool {
+	for _, a := range allowed {
+		if a == name {
+			return true
+		}
+	}
+	return false
+}
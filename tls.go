@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// TLSConfig settings for connections to Marathon.
+type TLSConfig struct {
+	CAFile             string `toml:"ca_file"`
+	CertFile           string `toml:"cert_file"`
+	KeyFile            string `toml:"key_file"`
+	ServerName         string `toml:"server_name"`
+	InsecureSkipVerify bool   `toml:"insecure_skip_verify"`
+}
+
+// reloadingTransport passes requests on to the current transport, which is
+// replaced whenever the certificate files change.
+type reloadingTransport struct {
+	sync.RWMutex
+	current *http.Transport
+}
+
+func (t *reloadingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.RLock()
+	current := t.current
+	t.RUnlock()
+	return current.RoundTrip(req)
+}
+
+func (t *reloadingTransport) replace(next *http.Transport) {
+	t.Lock()
+	old := t.current
+	t.current = next
+	t.Unlock()
+	old.CloseIdleConnections()
+}
+
+func (c TLSConfig) files() []string {
+	var files []string
+	for _, f := range []string{c.CAFile, c.CertFile, c.KeyFile} {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+func newTransport(c TLSConfig) (*http.Transport, error) {
+	t := &http.Transport{MaxIdleConnsPerHost: 10}
+	if len(c.files()) == 0 && c.ServerName == "" && !c.InsecureSkipVerify {
+		return t, nil
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CAFile != "" {
+		ca, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.New("no certificates found in " + c.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	t.TLSClientConfig = tlsConfig
+	return t, nil
+}
+
+// modTimes returns the modification times of the files, used to detect changes.
+func modTimes(files []string) map[string]time.Time {
+	times := make(map[string]time.Time)
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		times[f] = fi.ModTime()
+	}
+	return times
+}
+
+func changed(a, b map[string]time.Time) bool {
+	if len(a) != len(b) {
+		return true
+	}
+	for f, t := range a {
+		if !b[f].Equal(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func setupTLS() error {
+	t, err := newTransport(config.TLS)
+	if err != nil {
+		return err
+	}
+	tr.replace(t)
+	files := config.TLS.files()
+	if len(files) == 0 {
+		return nil
+	}
+	go func() {
+		// rotated certificates are picked up without a restart.
+		seen := modTimes(files)
+		ticker := time.NewTicker(10 * time.Second)
+		for range ticker.C {
+			current := modTimes(files)
+			if !changed(seen, current) {
+				continue
+			}
+			t, err := newTransport(config.TLS)
+			if err != nil {
+				logger.WithFields(logrus.Fields{
+					"error": err.Error(),
+				}).Error("unable to reload marathon tls certificates")
+				go countTLSReloadErrors.Inc()
+				continue
+			}
+			seen = current
+			tr.replace(t)
+			logger.Info("marathon tls certificates reloaded")
+		}
+	}()
+	return nil
+}
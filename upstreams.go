@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// UpstreamsConfig settings for updating upstreams without a reload.
+type UpstreamsConfig struct {
+	Mode     string
+	Endpoint string
+}
+
+// UpstreamUpdater changes the servers of upstreams in the running proxy.
+type UpstreamUpdater interface {
+	// Update sets the servers of every upstream, keyed by upstream name.
+	Update(upstreams map[string][]string) error
+}
+
+// upstreams is nil unless dynamic upstreams are configured.
+var upstreams UpstreamUpdater
+
+var upstreamsClient = &http.Client{Timeout: 10 * time.Second}
+
+func setupUpstreams() (UpstreamUpdater, error) {
+	c := config.DynamicUpstreams
+	if c.Mode == "" {
+		return nil, nil
+	}
+	if c.Endpoint == "" {
+		return nil, errors.New("dynamic upstreams need an endpoint")
+	}
+	// upstreams of other outputs would stay stale without a reload.
+	if len(outputs()) > 1 {
+		return nil, errors.New("dynamic upstreams only work with a single output")
+	}
+	switch c.Mode {
+	case "lua":
+		return &luaUpstreams{c.Endpoint}, nil
+	case "api":
+		return &apiUpstreams{c.Endpoint}, nil
+	}
+	return nil, fmt.Errorf("unknown dynamic upstreams mode %q", c.Mode)
+}
+
+// onlyTasksChanged is true if the same apps are there and only their tasks
+// changed, so the server blocks of the config stay the same.
+func onlyTasksChanged(old, apps map[string]App) bool {
+	if len(old) != len(apps) {
+		return false
+	}
+	for id, app := range apps {
+		oldapp, ok := old[id]
+		if !ok {
+			return false
+		}
+		oldapp.Tasks = nil
+		app.Tasks = nil
+		if !reflect.DeepEqual(oldapp, app) {
+			return false
+		}
+	}
+	return true
+}
+
+// upstreamServers returns the servers of every app as rendered by the
+// example templates, named after the first host of the app.
+func upstreamServers() map[string][]string {
+	config.RLock()
+	defer config.RUnlock()
+	servers := make(map[string][]string)
+	for _, app := range config.Apps {
+		name := app.Hosts[0]
+		servers[name] = []string{}
+		for _, task := range app.Tasks {
+			servers[name] = append(servers[name], task.Address+":"+strconv.FormatInt(task.Port, 10))
+		}
+		sort.Strings(servers[name])
+	}
+	return servers
+}
+
+// pushUpstreams sends the current servers to the running proxy.
+func pushUpstreams() error {
+	if upstreams == nil {
+		return errors.New("dynamic upstreams are not configured")
+	}
+	return upstreams.Update(upstreamServers())
+}
+
+func upstreamsRequest(method, endpoint string, body interface{}, v interface{}) error {
+	var buf bytes.Buffer
+	if body != nil {
+		err := json.NewEncoder(&buf).Encode(body)
+		if err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, endpoint, &buf)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := upstreamsClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New(method + " " + endpoint + ": " + resp.Status + ": " + string(b))
+	}
+	if v != nil {
+		return json.Unmarshal(b, v)
+	}
+	return nil
+}
+
+// luaUpstreams posts all upstreams as one JSON object to an endpoint of
+// the running OpenResty, which keeps them in a shared dict for
+// balancer_by_lua. See nginx-lua.tmpl.
+type luaUpstreams struct {
+	endpoint string
+}
+
+func (u *luaUpstreams) Update(upstreams map[string][]string) error {
+	return upstreamsRequest("POST", u.endpoint, upstreams, nil)
+}
+
+// apiUpstreams adds and removes servers through the nginx upstream api,
+// the endpoint is the versioned api root, e.g. http://127.0.0.1:8080/api/3
+type apiUpstreams struct {
+	endpoint string
+}
+
+// apiServer is a server of an upstream in the nginx upstream api.
+type apiServer struct {
+	ID     int    `json:"id,omitempty"`
+	Server string `json:"server"`
+}
+
+func (u *apiUpstreams) Update(upstreams map[string][]string) error {
+	for name, servers := range upstreams {
+		base := u.endpoint + "/http/upstreams/" + url.PathEscape(name) + "/servers"
+		var current []apiServer
+		err := upstreamsRequest("GET", base, nil, &current)
+		if err != nil {
+			return err
+		}
+		// add new servers first, so the upstream is never empty.
+		want := make(map[string]bool)
+		have := make(map[string]bool)
+		for _, server := range current {
+			have[server.Server] = true
+		}
+		for _, server := range servers {
+			want[server] = true
+			if have[server] {
+				continue
+			}
+			err = upstreamsRequest("POST", base, apiServer{Server: server}, nil)
+			if err != nil {
+				return err
+			}
+		}
+		for _, server := range current {
+			if want[server.Server] {
+				continue
+			}
+			err = upstreamsRequest("DELETE", base+"/"+strconv.Itoa(server.ID), nil, nil)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
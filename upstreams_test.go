@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeUpstreamAPI keeps the servers of upstreams like the nginx upstream
+// api and records every change, failing if an upstream ever runs empty.
+type fakeUpstreamAPI struct {
+	sync.Mutex
+	t         *testing.T
+	upstreams map[string][]apiServer
+	nextID    int
+	changes   []string
+}
+
+func (f *fakeUpstreamAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	// /api/3/http/upstreams/{name}/servers[/{id}]
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/3/http/upstreams/"), "/")
+	name := parts[0]
+	servers, ok := f.upstreams[name]
+	if !ok || len(parts) < 2 || parts[1] != "servers" {
+		http.Error(w, "upstream not found", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		json.NewEncoder(w).Encode(servers)
+	case "POST":
+		var server apiServer
+		json.NewDecoder(r.Body).Decode(&server)
+		f.nextID++
+		server.ID = f.nextID
+		f.upstreams[name] = append(servers, server)
+		f.changes = append(f.changes, "add "+name+" "+server.Server)
+		w.WriteHeader(http.StatusCreated)
+	case "DELETE":
+		id, _ := strconv.Atoi(parts[2])
+		var kept []apiServer
+		for _, server := range servers {
+			if server.ID == id {
+				f.changes = append(f.changes, "delete "+name+" "+server.Server)
+				continue
+			}
+			kept = append(kept, server)
+		}
+		if len(kept) == 0 {
+			f.t.Errorf("upstream %s ran empty", name)
+		}
+		f.upstreams[name] = kept
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (f *fakeUpstreamAPI) servers(name string) []string {
+	f.Lock()
+	defer f.Unlock()
+	var servers []string
+	for _, server := range f.upstreams[name] {
+		servers = append(servers, server.Server)
+	}
+	sort.Strings(servers)
+	return servers
+}
+
+func TestAPIUpstreamsUpdate(t *testing.T) {
+	api := &fakeUpstreamAPI{
+		t: t,
+		upstreams: map[string][]apiServer{
+			"app":   {{ID: 1, Server: "10.0.0.1:31000"}, {ID: 2, Server: "10.0.0.2:31000"}},
+			"other": {{ID: 3, Server: "10.0.0.3:31000"}},
+		},
+		nextID: 3,
+	}
+	server := httptest.NewServer(api)
+	defer server.Close()
+	u := &apiUpstreams{server.URL + "/api/3"}
+	err := u.Update(map[string][]string{
+		"app":   {"10.0.0.2:31000", "10.0.0.4:31000"},
+		"other": {"10.0.0.5:31000"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := api.servers("app"); !reflect.DeepEqual(got, []string{"10.0.0.2:31000", "10.0.0.4:31000"}) {
+		t.Errorf("app servers %v", got)
+	}
+	if got := api.servers("other"); !reflect.DeepEqual(got, []string{"10.0.0.5:31000"}) {
+		t.Errorf("other servers %v", got)
+	}
+	// new servers are added before old ones are deleted.
+	for _, name := range []string{"app", "other"} {
+		added, deleted := -1, -1
+		for i, change := range api.changes {
+			if strings.HasPrefix(change, "add "+name+" ") {
+				added = i
+			}
+			if strings.HasPrefix(change, "delete "+name+" ") && deleted == -1 {
+				deleted = i
+			}
+		}
+		if added == -1 || deleted == -1 || added > deleted {
+			t.Errorf("changes of %s in wrong order: %v", name, api.changes)
+		}
+	}
+}
+
+func TestAPIUpstreamsUnchanged(t *testing.T) {
+	api := &fakeUpstreamAPI{
+		t:         t,
+		upstreams: map[string][]apiServer{"app": {{ID: 1, Server: "10.0.0.1:31000"}}},
+		nextID:    1,
+	}
+	server := httptest.NewServer(api)
+	defer server.Close()
+	u := &apiUpstreams{server.URL + "/api/3"}
+	err := u.Update(map[string][]string{"app": {"10.0.0.1:31000"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(api.changes) != 0 {
+		t.Errorf("unexpected changes %v", api.changes)
+	}
+}
+
+func TestAPIUpstreamsUnknownUpstream(t *testing.T) {
+	api := &fakeUpstreamAPI{t: t, upstreams: map[string][]apiServer{}}
+	server := httptest.NewServer(api)
+	defer server.Close()
+	u := &apiUpstreams{server.URL + "/api/3"}
+	err := u.Update(map[string][]string{"missing": {"10.0.0.1:31000"}})
+	if err == nil {
+		t.Error("update of an unknown upstream succeeded")
+	}
+}
+
+func TestOnlyTasksChanged(t *testing.T) {
+	app := App{Hosts: []string{"app"}, Labels: map[string]string{"a": "b"}, Tasks: []Task{{Address: "10.0.0.1", Port: 31000}}}
+	scaled := app
+	scaled.Tasks = append([]Task{{Address: "10.0.0.2", Port: 31000}}, app.Tasks...)
+	relabeled := app
+	relabeled.Labels = map[string]string{"a": "c"}
+	tests := []struct {
+		name string
+		old  map[string]App
+		apps map[string]App
+		want bool
+	}{
+		{"scaled", map[string]App{"/app": app}, map[string]App{"/app": scaled}, true},
+		{"relabeled", map[string]App{"/app": app}, map[string]App{"/app": relabeled}, false},
+		{"new app", map[string]App{"/app": app}, map[string]App{"/app": app, "/new": app}, false},
+		{"renamed app", map[string]App{"/app": app}, map[string]App{"/new": app}, false},
+	}
+	for _, test := range tests {
+		if got := onlyTasksChanged(test.old, test.apps); got != test.want {
+			t.Errorf("%s: onlyTasksChanged = %v, expected %v", test.name, got, test.want)
+		}
+	}
+}
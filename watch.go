@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// templateWatch tracks template changes that are not rendered yet.
+type templateWatch struct {
+	sync.Mutex
+	changed bool
+}
+
+var templates templateWatch
+
+// take returns if the templates changed since the last call.
+func (t *templateWatch) take() bool {
+	t.Lock()
+	defer t.Unlock()
+	changed := t.changed
+	t.changed = false
+	return changed
+}
+
+// templateFiles returns all files the templates are parsed from,
+// including partials in template_dir.
+func templateFiles() []string {
+	var files []string
+	for _, o := range outputs() {
+		files = append(files, o.Template)
+	}
+	if config.TemplateDir != "" {
+		partials, _ := filepath.Glob(config.TemplateDir)
+		files = append(files, partials...)
+	}
+	return files
+}
+
+// watchTemplates polls the template files and queues a render when they
+// change, invalid templates are reported in the health check instead.
+func watchTemplates() {
+	interval := config.TemplateWatchInterval.Duration
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		seen := modTimes(templateFiles())
+		ticker := time.NewTicker(interval)
+		for range ticker.C {
+			current := modTimes(templateFiles())
+			if !changed(seen, current) {
+				continue
+			}
+			seen = current
+			err := checkTmpl()
+			if err != nil {
+				health.Template.Healthy = false
+				health.Template.Message = err.Error()
+				logger.WithFields(logrus.Fields{
+					"error": err.Error(),
+				}).Error("template changed but is invalid")
+				go countTemplateErrors.Inc()
+				continue
+			}
+			health.Template.Healthy = true
+			health.Template.Message = "OK"
+			logger.Info("template changed")
+			templates.Lock()
+			templates.changed = true
+			templates.Unlock()
+			select {
+			case eventqueue <- "template_changed":
+			default:
+			}
+		}
+	}()
+}
+
+// confChanged renders the templates and compares them with the installed
+// configs, a config that can not be rendered counts as changed.
+func confChanged() bool {
+	files, err := renderConf()
+	if err != nil {
+		return true
+	}
+	for path, b := range files {
+		current, err := ioutil.ReadFile(path)
+		if err != nil || !bytes.Equal(current, b) {
+			return true
+		}
+	}
+	return false
+}